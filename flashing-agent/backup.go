@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/rekby/gpt"
+	"github.com/tehwalris/ghw"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/efivars"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// readBackup reads everything which flashing overwrites outside of partitions:
+// the sectors which writing table overwrites, and the EFI boot variables.
+func readBackup(
+	diskF *os.File, diskInfo *ghw.Disk, serial string, table *gpt.Table, isEFI bool,
+) (*pb.Backup, error) {
+	regions, e := disk.ReadGptRegions(diskF, table)
+	if e != nil {
+		return nil, fmt.Errorf("while reading GPT sectors: %v", e)
+	}
+	b := &pb.Backup{
+		DiskCombinedSerial: serial,
+		SectorSize:         diskInfo.SectorSizeBytes,
+		DiskSize:           diskInfo.SizeBytes,
+	}
+	for _, r := range regions {
+		b.DiskRegions = append(b.DiskRegions, &pb.DiskRegion{Offset: r.Offset, Data: r.Data})
+	}
+	if !isEFI {
+		return b, nil
+	}
+	vars, e := efivars.ReadRawBootVars()
+	if e != nil {
+		return nil, fmt.Errorf("while reading boot variables: %v", e)
+	}
+	for k, d := range vars {
+		b.EfiVariables = append(b.EfiVariables, &pb.EfiVariable{Name: k, Data: d})
+	}
+	sort.Slice(b.EfiVariables, func(i, j int) bool {
+		return b.EfiVariables[i].Name < b.EfiVariables[j].Name
+	})
+	return b, nil
+}
+
+// restoreBackup writes a backup from readBackup back to the disk
+// with the same serial, which must still have the same size.
+func restoreBackup(logger *superlog.Logger, b *pb.Backup) error {
+	logger.Logf("restoring backup to disk with serial %v", b.DiskCombinedSerial)
+	diskF, diskInfo, e := disk.OpenBySerial(b.DiskCombinedSerial, false)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e := diskF.Close(); e != nil {
+			logger.Logf("while closing disk: %v", e)
+		}
+	}()
+	if diskInfo.SectorSizeBytes != b.SectorSize || diskInfo.SizeBytes != b.DiskSize {
+		return fmt.Errorf("disk has %v bytes with %v byte sectors, but backup has %v bytes with %v byte sectors",
+			diskInfo.SizeBytes, diskInfo.SectorSizeBytes, b.DiskSize, b.SectorSize)
+	}
+	var isEFI bool
+	if len(b.EfiVariables) > 0 {
+		if isEFI = efivars.IsEFIBooted(); !isEFI {
+			return fmt.Errorf("machine must be EFI booted to restore boot variables")
+		}
+	}
+
+	regions := make([]disk.Region, len(b.DiskRegions))
+	for i, r := range b.DiskRegions {
+		regions[i] = disk.Region{Offset: r.Offset, Data: r.Data}
+	}
+	if e := disk.WriteRegions(diskF, regions, b.SectorSize, b.DiskSize); e != nil {
+		return fmt.Errorf("while restoring disk sectors: %v", e)
+	}
+	if e := disk.FlushCache(diskF); e != nil {
+		return fmt.Errorf("while flushing disk: %v", e)
+	}
+	logger.Logf("restored %v disk regions", len(regions))
+
+	if isEFI {
+		vars := make(map[string][]byte)
+		for _, v := range b.EfiVariables {
+			vars[v.Name] = v.Data
+		}
+		if e := efivars.WriteRawBootVars(vars); e != nil {
+			return fmt.Errorf("while restoring boot variables: %v", e)
+		}
+		logger.Logf("restored %v boot variables", len(vars))
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Package bmap reads block map files as written by bmaptool.
+// A block map lists which blocks of a (sparse) image contain data,
+// along with checksums of those blocks.
+package bmap
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Range is a continuous range of mapped blocks.
+type Range struct {
+	First uint64 // first block (inclusive)
+	Last  uint64 // last block (inclusive)
+	Sum   []byte // nil if the block map has no checksum for this range
+}
+
+// Bmap is a parsed block map file.
+type Bmap struct {
+	ImageSize uint64
+	BlockSize uint64
+	// Ranges are sorted and do not overlap.
+	Ranges []Range
+
+	newHash func() hash.Hash
+}
+
+type xmlBmap struct {
+	Version          string     `xml:"version,attr"`
+	ImageSize        string     `xml:"ImageSize"`
+	BlockSize        string     `xml:"BlockSize"`
+	ChecksumType     string     `xml:"ChecksumType"`
+	BmapFileChecksum string     `xml:"BmapFileChecksum"`
+	BmapFileSHA1     string     `xml:"BmapFileSHA1"`
+	Ranges           []xmlRange `xml:"BlockMap>Range"`
+}
+
+type xmlRange struct {
+	Chksum string `xml:"chksum,attr"`
+	SHA1   string `xml:"sha1,attr"`
+	Blocks string `xml:",chardata"`
+}
+
+// Parse reads a block map file (format version 1.x or 2.x).
+// If the file contains a checksum of itself, it is verified.
+func Parse(r io.Reader) (*Bmap, error) {
+	raw, e := ioutil.ReadAll(r)
+	if e != nil {
+		return nil, e
+	}
+	var x xmlBmap
+	if e := xml.Unmarshal(raw, &x); e != nil {
+		return nil, fmt.Errorf("while parsing bmap XML: %v", e)
+	}
+
+	major := strings.SplitN(strings.TrimSpace(x.Version), ".", 2)[0]
+	b := &Bmap{}
+	fileSum := strings.TrimSpace(x.BmapFileChecksum)
+	switch major {
+	case "1":
+		b.newHash = sha1.New
+		fileSum = strings.TrimSpace(x.BmapFileSHA1)
+	case "2":
+		switch t := strings.TrimSpace(x.ChecksumType); t {
+		case "sha256":
+			b.newHash = sha256.New
+		case "sha1":
+			b.newHash = sha1.New
+		default:
+			return nil, fmt.Errorf("unsupported bmap checksum type %q", t)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported bmap version %q", x.Version)
+	}
+
+	if fileSum != "" {
+		if e := b.verifyFile(raw, fileSum); e != nil {
+			return nil, e
+		}
+	}
+
+	if b.ImageSize, e = parseUint(x.ImageSize); e != nil {
+		return nil, fmt.Errorf("invalid ImageSize: %v", e)
+	}
+	if b.BlockSize, e = parseUint(x.BlockSize); e != nil || b.BlockSize == 0 {
+		return nil, fmt.Errorf("invalid BlockSize %q", x.BlockSize)
+	}
+
+	for _, xr := range x.Ranges {
+		r, e := b.parseRange(xr)
+		if e != nil {
+			return nil, e
+		}
+		if n := len(b.Ranges); n > 0 && r.First <= b.Ranges[n-1].Last {
+			return nil, fmt.Errorf("bmap ranges are not sorted or overlap at block %v", r.First)
+		}
+		if r.First*b.BlockSize >= b.ImageSize {
+			return nil, fmt.Errorf("bmap range starting at block %v is outside of the image", r.First)
+		}
+		b.Ranges = append(b.Ranges, r)
+	}
+	return b, nil
+}
+
+func (b *Bmap) parseRange(xr xmlRange) (Range, error) {
+	var r Range
+	blocks := strings.SplitN(strings.TrimSpace(xr.Blocks), "-", 2)
+	var e error
+	if r.First, e = parseUint(blocks[0]); e != nil {
+		return r, fmt.Errorf("invalid bmap range %q", xr.Blocks)
+	}
+	r.Last = r.First
+	if len(blocks) == 2 {
+		if r.Last, e = parseUint(blocks[1]); e != nil || r.Last < r.First {
+			return r, fmt.Errorf("invalid bmap range %q", xr.Blocks)
+		}
+	}
+	sum := xr.Chksum
+	if sum == "" {
+		sum = xr.SHA1
+	}
+	if sum != "" {
+		if r.Sum, e = hex.DecodeString(sum); e != nil || len(r.Sum) != b.newHash().Size() {
+			return r, fmt.Errorf("invalid checksum for bmap range %q", xr.Blocks)
+		}
+	}
+	return r, nil
+}
+
+// verifyFile checks the checksum of the bmap file itself. It is calculated
+// with the checksum in the file replaced by zeros.
+func (b *Bmap) verifyFile(raw []byte, sum string) error {
+	exp, e := hex.DecodeString(sum)
+	if e != nil {
+		return fmt.Errorf("invalid bmap file checksum: %v", e)
+	}
+	zeroed := bytes.Replace(raw, []byte(sum), bytes.Repeat([]byte("0"), len(sum)), 1)
+	h := b.newHash()
+	h.Write(zeroed)
+	if act := h.Sum(nil); !bytes.Equal(act, exp) {
+		return fmt.Errorf("bmap file checksum mismatch (got %x, want %x)", act, exp)
+	}
+	return nil
+}
+
+// ByteRange returns the range of image bytes covered by r.
+// The last range of an image may be shorter than its blocks.
+func (b *Bmap) ByteRange(r Range) (start uint64, end uint64) {
+	start = r.First * b.BlockSize
+	end = (r.Last + 1) * b.BlockSize
+	if end > b.ImageSize {
+		end = b.ImageSize
+	}
+	return start, end
+}
+
+func parseUint(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+}
@@ -0,0 +1,178 @@
+package bmap_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/bmap"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+)
+
+const blockSize = 4
+
+// testImage has 10 blocks, the last one is only 2 bytes long.
+var testImage = []byte("AAAABBBBCCCCDDDDEEEEFFFFGGGGHHHHIIIIJJ")
+
+func sum(start, end int) string {
+	s := sha256.Sum256(testImage[start:end])
+	return hex.EncodeToString(s[:])
+}
+
+// makeBmap returns a block map with blocks 1-2, 5 and 8-9 mapped.
+// If fileSum is set, the file contains a valid checksum of itself, otherwise none.
+func makeBmap(rangeSum1 string, fileSum bool) string {
+	tmpl := `<?xml version="1.0" ?>
+<bmap version="2.0">
+    <ImageSize> %v </ImageSize>
+    <BlockSize> %v </BlockSize>
+    <BlocksCount> 10 </BlocksCount>
+    <MappedBlocksCount> 5 </MappedBlocksCount>
+    <ChecksumType> sha256 </ChecksumType>
+    <BmapFileChecksum> %v </BmapFileChecksum>
+    <BlockMap>
+        <Range chksum="%v"> 1-2 </Range>
+        <Range chksum="%v"> 5 </Range>
+        <Range chksum="%v"> 8-9 </Range>
+    </BlockMap>
+</bmap>`
+	zeros := strings.Repeat("0", 64)
+	doc := fmt.Sprintf(tmpl, len(testImage), blockSize, zeros, rangeSum1, sum(20, 24), sum(32, 38))
+	if fileSum {
+		s := sha256.Sum256([]byte(doc))
+		doc = strings.Replace(doc, zeros, hex.EncodeToString(s[:]), 1)
+	} else {
+		doc = strings.Replace(doc, "    <BmapFileChecksum> "+zeros+" </BmapFileChecksum>\n", "", 1)
+	}
+	return doc
+}
+
+func TestParse(t *testing.T) {
+	b, e := bmap.Parse(strings.NewReader(makeBmap(sum(4, 12), true)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if b.ImageSize != uint64(len(testImage)) || b.BlockSize != blockSize {
+		t.Errorf("got image size %v and block size %v", b.ImageSize, b.BlockSize)
+	}
+	var blocks [][2]uint64
+	for _, r := range b.Ranges {
+		blocks = append(blocks, [2]uint64{r.First, r.Last})
+	}
+	if exp := [][2]uint64{{1, 2}, {5, 5}, {8, 9}}; !reflect.DeepEqual(blocks, exp) {
+		t.Errorf("got ranges %v, want %v", blocks, exp)
+	}
+	if start, end := b.ByteRange(b.Ranges[2]); start != 32 || end != 38 {
+		t.Errorf("got byte range %v-%v for last range, want 32-38", start, end)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := makeBmap(sum(4, 12), true)
+	cases := []struct {
+		label string
+		doc   string
+	}{
+		{"not XML", "walrus"},
+		{"bad file checksum", strings.Replace(valid, "<BlocksCount> 10", "<BlocksCount> 11", 1)},
+		{"bad version", strings.Replace(makeBmap(sum(4, 12), false), `version="2.0"`, `version="3.0"`, 1)},
+		{"bad checksum type", strings.Replace(makeBmap(sum(4, 12), false), "sha256 <", "md5 <", 1)},
+		{"bad range", strings.Replace(makeBmap(sum(4, 12), false), "> 5 </Range>", "> 5-3 </Range>", 1)},
+		{"unsorted ranges", strings.Replace(makeBmap(sum(4, 12), false), "> 5 </Range>", "> 0 </Range>", 1)},
+		{"range outside image", strings.Replace(makeBmap(sum(4, 12), false), "> 8-9 <", "> 10-11 <", 1)},
+		{"bad range checksum", makeBmap("1234", false)},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			if _, e := bmap.Parse(strings.NewReader(c.doc)); e == nil {
+				t.Errorf("got no error, want some error")
+			}
+		})
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	b, e := bmap.Parse(strings.NewReader(makeBmap(sum(4, 12), false)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	tasks := []copyimg.Task{
+		{Src: 0, Dst: 100, Size: 10},
+		{Src: 16, Dst: 200, Size: 22},
+	}
+	expMapped := []copyimg.Task{
+		{Src: 4, Dst: 104, Size: 6},
+		{Src: 20, Dst: 204, Size: 4},
+		{Src: 32, Dst: 216, Size: 6},
+	}
+	expUnmapped := []copyimg.Task{
+		{Src: 0, Dst: 100, Size: 4},
+		{Src: 16, Dst: 200, Size: 4},
+		{Src: 24, Dst: 208, Size: 8},
+	}
+	if act := b.Intersect(tasks); !reflect.DeepEqual(act, expMapped) {
+		t.Errorf("got mapped tasks %v, want %v", act, expMapped)
+	}
+	if act := b.Unmapped(tasks); !reflect.DeepEqual(act, expUnmapped) {
+		t.Errorf("got unmapped tasks %v, want %v", act, expUnmapped)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	cases := []struct {
+		label      string
+		rangeSum1  string
+		readLen    int64
+		shouldFail bool
+	}{
+		{"valid", sum(4, 12), int64(len(testImage)), false},
+		{"mismatch", sum(4, 11), int64(len(testImage)), true},
+		{"mismatch in partially read range", sum(4, 11), 6, true},
+		{"partially read", sum(4, 12), 6, false},
+		{"nothing mapped read", sum(4, 11), 4, false},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			b, e := bmap.Parse(strings.NewReader(makeBmap(c.rangeSum1, false)))
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			v := b.NewVerifyingReader(&chunkReader{bytes.NewReader(testImage), 3})
+			act, e := ioutil.ReadAll(io.LimitReader(v, c.readLen))
+			if e == nil {
+				e = v.Finish()
+			}
+			if c.shouldFail {
+				if e == nil {
+					t.Errorf("got no error, want some error")
+				}
+				return
+			}
+			if e != nil {
+				t.Errorf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(act, testImage[:c.readLen]) {
+				t.Errorf("got %q, want %q", act, testImage[:c.readLen])
+			}
+		})
+	}
+}
+
+// chunkReader reads at most n bytes at a time.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,50 @@
+package bmap
+
+import (
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+)
+
+// Intersect returns copy tasks which only copy the mapped parts of the source
+// regions of the given tasks. The tasks must not have overlapping source regions.
+func (b *Bmap) Intersect(tasks []copyimg.Task) []copyimg.Task {
+	var out []copyimg.Task
+	for _, t := range tasks {
+		for _, r := range b.Ranges {
+			start, end := b.ByteRange(r)
+			if start < t.Src {
+				start = t.Src
+			}
+			if end > t.Src+t.Size {
+				end = t.Src + t.Size
+			}
+			if start >= end {
+				continue
+			}
+			out = append(out, copyimg.Task{
+				Src:  start,
+				Dst:  t.Dst + (start - t.Src),
+				Size: end - start,
+			})
+		}
+	}
+	return out
+}
+
+// Unmapped returns the parts of tasks which Intersect does not copy.
+func (b *Bmap) Unmapped(tasks []copyimg.Task) []copyimg.Task {
+	var out []copyimg.Task
+	add := func(t copyimg.Task, start uint64, end uint64) {
+		if start < end {
+			out = append(out, copyimg.Task{Src: start, Dst: t.Dst + (start - t.Src), Size: end - start})
+		}
+	}
+	for _, t := range tasks {
+		pos := t.Src
+		for _, m := range b.Intersect([]copyimg.Task{t}) {
+			add(t, pos, m.Src)
+			pos = m.Src + m.Size
+		}
+		add(t, pos, t.Src+t.Size)
+	}
+	return out
+}
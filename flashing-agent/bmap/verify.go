@@ -0,0 +1,96 @@
+package bmap
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// VerifyingReader checks the checksums of all mapped ranges of an image
+// while it is being read. Reading fails as soon as a range does not match.
+type VerifyingReader struct {
+	b      *Bmap
+	r      io.Reader
+	offset uint64
+	next   int       // index of the first range which was not checked yet
+	h      hash.Hash // hash of the current range, nil before it starts
+	err    error     // first checksum mismatch
+}
+
+// NewVerifyingReader wraps r, which must return the image from its first byte.
+func (b *Bmap) NewVerifyingReader(r io.Reader) *VerifyingReader {
+	return &VerifyingReader{b: b, r: r}
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, e := v.r.Read(p)
+	if v.err = v.update(p[:n]); v.err != nil {
+		return n, v.err
+	}
+	return n, e
+}
+
+func (v *VerifyingReader) update(p []byte) error {
+	for len(p) > 0 && v.next < len(v.b.Ranges) {
+		r := v.b.Ranges[v.next]
+		start, end := v.b.ByteRange(r)
+		if v.offset < start {
+			skip := start - v.offset
+			if skip > uint64(len(p)) {
+				skip = uint64(len(p))
+			}
+			v.offset += skip
+			p = p[skip:]
+			continue
+		}
+		if v.h == nil {
+			v.h = v.b.newHash()
+		}
+		l := end - v.offset
+		if l > uint64(len(p)) {
+			l = uint64(len(p))
+		}
+		v.h.Write(p[:l])
+		v.offset += l
+		p = p[l:]
+		if v.offset == end {
+			sum := v.h.Sum(nil)
+			v.h = nil
+			v.next++
+			if r.Sum != nil && !bytes.Equal(sum, r.Sum) {
+				return fmt.Errorf("checksum mismatch for bmap range %v-%v", r.First, r.Last)
+			}
+		}
+	}
+	v.offset += uint64(len(p))
+	return nil
+}
+
+// Finish reads the rest of the range which is currently being read,
+// so that all data read so far has been verified. It also returns
+// mismatches which were found earlier, in case a reader ignored them.
+func (v *VerifyingReader) Finish() error {
+	if v.err != nil || v.h == nil {
+		return v.err
+	}
+	_, end := v.b.ByteRange(v.b.Ranges[v.next])
+	// Not io.CopyN, since it ignores errors which come with the last byte.
+	buf := make([]byte, 32*1024)
+	for v.offset < end {
+		l := end - v.offset
+		if l > uint64(len(buf)) {
+			l = uint64(len(buf))
+		}
+		if _, e := v.Read(buf[:l]); e != nil {
+			if e == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return e
+		}
+	}
+	return nil
+}
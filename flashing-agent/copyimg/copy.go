@@ -1,9 +1,10 @@
 package copyimg
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"sort"
 
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
@@ -17,6 +18,40 @@ type Task struct {
 	Size uint64 // number of bytes to copy
 }
 
+// Checksum is the SHA-256 of the data copied by a single task.
+type Checksum [sha256.Size]byte
+
+// Options configures optional behaviour of Copy.
+type Options struct {
+	// If Sums is not nil, Copy stores the checksum of the data written
+	// for unsortedTasks[i] in Sums[i]. It must have the same length as unsortedTasks.
+	Sums []Checksum
+
+	// ZeroMode selects how blocks which only contain zeros are handled.
+	// Zero blocks are ZeroBlockSize bytes long (64 KiB if 0) and aligned relative
+	// to the start of the destination. ZeroBlockSize is ignored with WriteZeros.
+	ZeroMode      ZeroMode
+	ZeroBlockSize uint64
+
+	// With ZeroOut, Zeroer is only used for whole sectors of SectorSize
+	// bytes (512 if 0). The parts of zero ranges outside of them are written.
+	// If the destination does not support zeroing, zero blocks are written
+	// from then on and OnZeroUnsupported (which may be nil) is called.
+	SectorSize        uint64
+	OnZeroUnsupported func(e error)
+
+	// If Stats is not nil, Copy stores statistics about the transfer in it.
+	Stats *Stats
+
+	// Data is passed from reading to writing in BufferCount buffers
+	// (4 if 0) of BufferSize bytes (4 MiB if 0). Buffers are aligned in memory
+	// for O_DIRECT. Writes inside of tasks are aligned to BufferSize relative to
+	// the start of the destination. With ZeroOut or SkipZeros,
+	// BufferSize must be a multiple of ZeroBlockSize.
+	BufferSize  int
+	BufferCount int
+}
+
 // CopyToSeeker copies specified regions from a non-seekable source to a seekable destination.
 // The specified copy tasks do not have to be ordered.
 // CopyToSeeker fails if two tasks have overlapping source regions.
@@ -28,11 +63,56 @@ type Task struct {
 // on the progress channel after each task is completed successfully.
 // CopyToSeeker will close the progress channel whether it completes sucessfully or not.
 func CopyToSeeker(dst io.WriteSeeker, src io.Reader, unsortedTasks []Task, progress chan<- uint64) error {
+	return Copy(dst, src, unsortedTasks, progress, Options{})
+}
+
+// Copy is like CopyToSeeker, but supports additional options.
+// Reading from src and writing to dst happen concurrently.
+func Copy(
+	dst io.WriteSeeker, src io.Reader, unsortedTasks []Task, progress chan<- uint64, opts Options,
+) error {
 	defer close(progress)
 
+	if opts.Sums != nil && len(opts.Sums) != len(unsortedTasks) {
+		return fmt.Errorf("got %v checksum slots for %v tasks", len(opts.Sums), len(unsortedTasks))
+	}
+	c := newCopier(dst, src, opts)
+	if e := c.checkOptions(); e != nil {
+		return e
+	}
+	if opts.Stats != nil {
+		defer func() { *opts.Stats = c.stats }()
+	}
+
+	tasks, e := sortTasks(unsortedTasks)
+	if e != nil {
+		return e
+	}
+	return c.run(tasks.d, tasks.idx, progress)
+}
+
+// checkOptions validates options after defaults were applied by newCopier.
+func (c *copier) checkOptions() error {
+	if c.opts.BufferSize <= 0 || c.opts.BufferCount <= 0 {
+		return fmt.Errorf("got %v buffers of %v bytes", c.opts.BufferCount, c.opts.BufferSize)
+	}
+	if c.opts.ZeroMode != WriteZeros && uint64(c.opts.BufferSize)%c.opts.ZeroBlockSize != 0 {
+		return fmt.Errorf("buffer size %v is not a multiple of zero block size %v",
+			c.opts.BufferSize, c.opts.ZeroBlockSize)
+	}
+	return nil
+}
+
+// sortTasks sorts tasks by their source offset.
+// It fails if the source or destination regions of any tasks overlap.
+func sortTasks(unsortedTasks []Task) (tasks, error) {
 	var tasks tasks
 	tasks.d = make([]Task, len(unsortedTasks))
 	copy(tasks.d, unsortedTasks)
+	tasks.idx = make([]int, len(unsortedTasks))
+	for i := range tasks.idx {
+		tasks.idx[i] = i
+	}
 
 	tasks.useDst = true
 	sort.Sort(tasks)
@@ -40,7 +120,7 @@ func CopyToSeeker(dst io.WriteSeeker, src io.Reader, unsortedTasks []Task, progr
 	for _, t := range tasks.d {
 		delta := int64(t.Dst) - i
 		if delta < 0 {
-			return fmt.Errorf("destination regions of tasks overlap")
+			return tasks, fmt.Errorf("destination regions of tasks overlap")
 		}
 		i = int64(t.Dst + t.Size)
 	}
@@ -49,33 +129,42 @@ func CopyToSeeker(dst io.WriteSeeker, src io.Reader, unsortedTasks []Task, progr
 	sort.Sort(tasks)
 	i = 0
 	for _, t := range tasks.d {
-		srcDelta := int64(t.Src) - i
-		if srcDelta < 0 {
-			return fmt.Errorf("source regions of tasks overlap")
+		if int64(t.Src) < i {
+			return tasks, fmt.Errorf("source regions of tasks overlap")
 		}
-		n, e := io.CopyN(ioutil.Discard, src, srcDelta)
-		if e != nil {
-			return e
-		}
-		i += n
+		i = int64(t.Src + t.Size)
+	}
+
+	return tasks, nil
+}
 
+// Verify reads the destination regions of tasks back from dst and compares
+// them to the checksums recorded by Copy (sums[i] belongs to tasks[i]).
+// It returns the tasks whose data does not match.
+func Verify(dst io.ReadSeeker, tasks []Task, sums []Checksum) ([]Task, error) {
+	if len(sums) != len(tasks) {
+		return nil, fmt.Errorf("got %v checksums for %v tasks", len(sums), len(tasks))
+	}
+	var bad []Task
+	for i, t := range tasks {
 		if _, e := dst.Seek(int64(t.Dst), io.SeekStart); e != nil {
-			return e
+			return nil, e
 		}
-
-		n, e = io.CopyN(dst, src, int64(t.Size))
-		if e != nil {
-			return e
+		h := sha256.New()
+		if _, e := io.CopyN(h, dst, int64(t.Size)); e != nil {
+			return nil, e
+		}
+		if !bytes.Equal(h.Sum(nil), sums[i][:]) {
+			bad = append(bad, t)
 		}
-		i += n
-		progress <- t.Size
 	}
-	return nil
+	return bad, nil
 }
 
 // Tasks wraps []Task, so that sort.Interface can be implemented.
 type tasks struct {
 	d      []Task
+	idx    []int // index of each task before sorting
 	useDst bool
 }
 
@@ -92,6 +181,7 @@ func (c tasks) Swap(i, j int) {
 	ti := c.d[i]
 	c.d[i] = c.d[j]
 	c.d[j] = ti
+	c.idx[i], c.idx[j] = c.idx[j], c.idx[i]
 }
 
 // PlanFromGPTs plans copy operations to transfer data for all partitions which are in both GPT tables.
@@ -99,6 +189,7 @@ func (c tasks) Swap(i, j int) {
 // Empty partitions (GPT type 0) are ignored.
 // Nothing except the partition contents is copied (not even the GPT tables themselves).
 // Only partition sizes from the source are used. Sizes of destination partitions are ignored.
+// Offsets are in bytes, so the tables may have different sector sizes.
 // The passed GPT tables are generally not validated (eg. for duplicate partitions).
 // Because of this, it is not guaranteed that copy tasks do not overlap.
 func PlanFromGPTs(dst *gpt.Table, src *gpt.Table) ([]Task, error) {
@@ -131,9 +222,19 @@ func PlanFromGPTs(dst *gpt.Table, src *gpt.Table) ([]Task, error) {
 // It does not guarantee that every task will be split, since that is not always possible.
 // SplitTasks panics for n < 1.
 func SplitTasks(tasks []Task, n int) []Task {
+	return SplitTasksAligned(tasks, n, 1)
+}
+
+// SplitTasksAligned is like SplitTasks, but only splits tasks at destination
+// offsets which are multiples of align, eg. the sector size for O_DIRECT.
+// SplitTasksAligned panics for align < 1.
+func SplitTasksAligned(tasks []Task, n int, align uint64) []Task {
 	if n < 1 {
 		panic(fmt.Sprintf("got n = %v, want n < 1", n))
 	}
+	if align < 1 {
+		panic(fmt.Sprintf("got align = %v, want align >= 1", align))
+	}
 	if n <= len(tasks) {
 		out := make([]Task, len(tasks))
 		copy(out, tasks)
@@ -150,13 +251,18 @@ func SplitTasks(tasks []Task, n int) []Task {
 	}
 	var out []Task
 	for _, t := range tasks {
-		for t.Size > part {
+		for {
+			// The first aligned offset at least part bytes into the task.
+			split := (t.Dst + part + align - 1) / align * align
+			if split >= t.Dst+t.Size {
+				break
+			}
 			extra := t
-			extra.Size = part
+			extra.Size = split - t.Dst
 			out = append(out, extra)
-			t.Src += part
-			t.Dst += part
-			t.Size -= part
+			t.Src += extra.Size
+			t.Dst += extra.Size
+			t.Size -= extra.Size
 		}
 		out = append(out, t)
 	}
@@ -5,11 +5,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
 	"github.com/rekby/gpt"
 )
 
@@ -329,6 +333,137 @@ func (t *WritableBuf) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+func (t *WritableBuf) Read(p []byte) (int, error) {
+	if t.offset >= int64(len(t.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, t.buf[t.offset:])
+	t.offset += int64(n)
+	return n, nil
+}
+
+func TestCopyVerify(t *testing.T) {
+	srcData := []byte{0x03, 0x88, 0x45, 0xAA, 0x88, 0x99, 0xFE, 0x72}
+	tasks := []copyimg.Task{
+		{Src: 4, Dst: 0, Size: 3},
+		{Src: 0, Dst: 4, Size: 2},
+		{Src: 7, Dst: 7, Size: 1},
+	}
+	cases := []struct {
+		label   string
+		corrupt []int // indexes of destination bytes changed after copying
+		expBad  []copyimg.Task
+	}{
+		{"no corruption", nil, nil},
+		{"corruption outside of tasks", []int{3, 6}, nil},
+		{"single corrupted task", []int{5}, []copyimg.Task{tasks[1]}},
+		{"multiple corrupted tasks", []int{0, 2, 7}, []copyimg.Task{tasks[0], tasks[2]}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			dst := NewWB(make([]byte, len(srcData)))
+			progC := make(chan uint64, len(tasks))
+			sums := make([]copyimg.Checksum, len(tasks))
+			opts := copyimg.Options{Sums: sums}
+			if e := copyimg.Copy(dst, bytes.NewReader(srcData), tasks, progC, opts); e != nil {
+				t.Fatalf("unexpected error while copying: %v", e)
+			}
+			for _, i := range c.corrupt {
+				dst.buf[i] ^= 0xFF
+			}
+			act, e := copyimg.Verify(dst, tasks, sums)
+			if e != nil {
+				t.Fatalf("unexpected error while verifying: %v", e)
+			}
+			if !(reflect.DeepEqual(act, c.expBad) || (len(act) == 0 && len(c.expBad) == 0)) {
+				t.Errorf("got %v, want %v", act, c.expBad)
+			}
+		})
+	}
+}
+
+func TestCopyWrongSumCount(t *testing.T) {
+	progC := make(chan uint64, 1)
+	tasks := []copyimg.Task{{Src: 0, Dst: 0, Size: 1}}
+	opts := copyimg.Options{Sums: make([]copyimg.Checksum, 2)}
+	if e := copyimg.Copy(NewWB(make([]byte, 1)), bytes.NewReader([]byte{1}), tasks, progC, opts); e == nil {
+		t.Errorf("got no error, want some error")
+	}
+}
+
+func TestCopyBuffers(t *testing.T) {
+	srcData := make([]byte, 200)
+	for i := range srcData {
+		if i%40 >= 20 {
+			srcData[i] = byte(i*7 + 1)
+		}
+	}
+	tasks := []copyimg.Task{
+		{Src: 150, Dst: 3, Size: 50},
+		{Src: 5, Dst: 64, Size: 97},
+		{Src: 102, Dst: 170, Size: 0},
+		{Src: 110, Dst: 180, Size: 20},
+	}
+	exp := bytes.Repeat([]byte{0xEE}, 210)
+	for _, task := range tasks {
+		copy(exp[task.Dst:], srcData[task.Src:task.Src+task.Size])
+	}
+
+	cases := []struct {
+		bufSize  int
+		bufCount int
+		zeroMode copyimg.ZeroMode
+	}{
+		{1, 1, copyimg.WriteZeros},
+		{7, 1, copyimg.WriteZeros},
+		{16, 3, copyimg.WriteZeros},
+		{0, 0, copyimg.WriteZeros},
+		{8, 2, copyimg.ZeroOut},
+		{4, 5, copyimg.ZeroOut},
+		{0, 0, copyimg.ZeroOut},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%vx%v bytes, zero mode %v", c.bufCount, c.bufSize, c.zeroMode), func(t *testing.T) {
+			dst := &ZeroingBuf{WritableBuf: NewWB(bytes.Repeat([]byte{0xEE}, 210))}
+			progC := make(chan uint64, len(tasks))
+			sums := make([]copyimg.Checksum, len(tasks))
+			opts := copyimg.Options{
+				Sums:          sums,
+				ZeroMode:      c.zeroMode,
+				ZeroBlockSize: 4,
+				BufferSize:    c.bufSize,
+				BufferCount:   c.bufCount,
+			}
+			if e := copyimg.Copy(dst, bytes.NewReader(srcData), tasks, progC, opts); e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(dst.buf, exp) {
+				t.Errorf("got %v, want %v", hex.EncodeToString(dst.buf), hex.EncodeToString(exp))
+			}
+			var prog []uint64
+			for v := range progC {
+				prog = append(prog, v)
+			}
+			if expProg := []uint64{97, 0, 20, 50}; !reflect.DeepEqual(prog, expProg) {
+				t.Errorf("got progress %v, want %v", prog, expProg)
+			}
+			if bad, e := copyimg.Verify(NewWB(exp), tasks, sums); e != nil || len(bad) != 0 {
+				t.Errorf("got checksum mismatches %v (error: %v), want none", bad, e)
+			}
+		})
+	}
+}
+
+func TestCopyBufferSizeNotZeroBlockMultiple(t *testing.T) {
+	progC := make(chan uint64, 1)
+	tasks := []copyimg.Task{{Src: 0, Dst: 0, Size: 1}}
+	opts := copyimg.Options{ZeroMode: copyimg.ZeroOut, ZeroBlockSize: 4, BufferSize: 6}
+	if e := copyimg.Copy(NewWB(make([]byte, 1)), bytes.NewReader([]byte{1}), tasks, progC, opts); e == nil {
+		t.Errorf("got no error, want some error")
+	}
+}
+
 func TestSplitTasks(t *testing.T) {
 	cases := []struct {
 		label  string
@@ -441,3 +576,143 @@ func TestSplitTasks(t *testing.T) {
 		})
 	}
 }
+
+// slowReader returns data with a fixed delay per KiB, like a network download.
+type slowReader struct {
+	nsPerKiB time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.nsPerKiB * time.Duration(len(p)) / 1024)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	return len(p), nil
+}
+
+// copyN is the io.CopyN loop which Copy replaced, as a baseline for BenchmarkCopy.
+func copyN(dst io.WriteSeeker, src io.Reader, tasks []copyimg.Task) error {
+	for _, t := range tasks {
+		if _, e := dst.Seek(int64(t.Dst), io.SeekStart); e != nil {
+			return e
+		}
+		if _, e := io.CopyN(dst, src, int64(t.Size)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func BenchmarkCopy(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	pipelined := func(opts copyimg.Options) func(*os.File, io.Reader, []copyimg.Task) error {
+		return func(f *os.File, r io.Reader, tasks []copyimg.Task) error {
+			return copyimg.Copy(f, r, tasks, make(chan uint64, 1), opts)
+		}
+	}
+	cases := []struct {
+		label string
+		copy  func(*os.File, io.Reader, []copyimg.Task) error
+	}{
+		{"io.CopyN", func(f *os.File, r io.Reader, tasks []copyimg.Task) error { return copyN(f, r, tasks) }},
+		{"unbuffered (1x32KiB)", pipelined(copyimg.Options{BufferSize: 32 * 1024, BufferCount: 1})},
+		{"pipelined (4x4MiB)", pipelined(copyimg.Options{})},
+	}
+	for _, c := range cases {
+		b.Run(c.label, func(b *testing.B) {
+			f, e := ioutil.TempFile("", "copyimg-bench")
+			if e != nil {
+				b.Fatal(e)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				tasks := []copyimg.Task{{Src: 0, Dst: 0, Size: size}}
+				if e := c.copy(f, slowReader{nsPerKiB: 500}, tasks); e != nil {
+					b.Fatal(e)
+				}
+				if e := f.Sync(); e != nil {
+					b.Fatal(e)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitTasksAligned(t *testing.T) {
+	input := []copyimg.Task{
+		{Src: 7, Dst: 512, Size: 20<<20 + 3584},
+		{Src: 30 << 20, Dst: 1000, Size: 5000},
+	}
+	act := copyimg.SplitTasksAligned(input, 100, 512)
+	if len(act) < 50 {
+		t.Errorf("got %v tasks, want about 100", len(act))
+	}
+	var size uint64
+	for i, task := range act {
+		if i > 0 && act[i-1].Dst+act[i-1].Size == task.Dst && task.Dst%512 != 0 {
+			t.Errorf("task %v was split at unaligned offset %v", i, task.Dst)
+		}
+		size += task.Size
+	}
+	if exp := input[0].Size + input[1].Size; size != exp {
+		t.Errorf("got tasks of %v bytes, want %v", size, exp)
+	}
+
+	// An unaligned task is split at aligned offsets only.
+	act = copyimg.SplitTasksAligned([]copyimg.Task{{Src: 0, Dst: 1000, Size: 5000}}, 10, 1024)
+	exp := []copyimg.Task{
+		{Src: 0, Dst: 1000, Size: 1048},
+		{Src: 1048, Dst: 2048, Size: 1024},
+		{Src: 2072, Dst: 3072, Size: 1024},
+		{Src: 3096, Dst: 4096, Size: 1024},
+		{Src: 4120, Dst: 5120, Size: 880},
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("got tasks %+v, want %+v", act, exp)
+	}
+}
+
+func TestCopySplitTasksDirect(t *testing.T) {
+	f, e := ioutil.TempFile("", "copyimg")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size := 21 << 20
+	if e := f.Truncate(int64(size)); e != nil {
+		t.Fatal(e)
+	}
+	df, e := disk.OpenDirect(f)
+	if e == syscall.EINVAL {
+		t.Skipf("file system does not support O_DIRECT")
+	} else if e != nil {
+		t.Fatal(e)
+	}
+	defer df.Close()
+
+	srcData := make([]byte, 20<<20+3584)
+	for i := range srcData {
+		if i%(3<<20) > 1<<20 {
+			srcData[i] = byte(i*7 + 1)
+		}
+	}
+	tasks := copyimg.SplitTasksAligned([]copyimg.Task{{Src: 0, Dst: 4096, Size: uint64(len(srcData))}}, 100, 512)
+	for _, mode := range []copyimg.ZeroMode{copyimg.WriteZeros, copyimg.ZeroOut} {
+		progC := make(chan uint64, len(tasks))
+		opts := copyimg.Options{ZeroMode: mode, SectorSize: 512}
+		if e := copyimg.Copy(disk.Device{File: df}, bytes.NewReader(srcData), tasks, progC, opts); e != nil {
+			t.Fatalf("zero mode %v: unexpected error: %v", mode, e)
+		}
+		out, e := ioutil.ReadFile(f.Name())
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(out[4096:4096+len(srcData)], srcData) {
+			t.Errorf("zero mode %v: file contents differ from source", mode)
+		}
+	}
+}
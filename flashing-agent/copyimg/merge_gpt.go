@@ -16,9 +16,12 @@ func partitionsToIds(partitions []pb.FlashingConfig_Partition) []string {
 	return ids
 }
 
+// MergeGpt places the partitions of the image and missing persistent partitions
+// in diskGpt. New partitions start at a multiple of align blocks. Image partitions
+// are translated to the sector size of the disk.
 // WARNING Modifies diskGpt (in memory)
 func MergeGpt(
-	diskGpt *gpt.Table, imageGpt *gpt.Table, persistent []pb.FlashingConfig_Partition,
+	diskGpt *gpt.Table, imageGpt *gpt.Table, persistent []pb.FlashingConfig_Partition, align uint64,
 ) error {
 	if e := partition.AssertGptCompatible(diskGpt, imageGpt); e != nil {
 		return e
@@ -47,11 +50,15 @@ func MergeGpt(
 
 	partition.RemoveExcept(diskGpt, partitionsToIds(persistent))
 	for i, _ := range persistent {
-		partition.AddPersistentIfMissing(diskGpt, &persistent[i])
+		partition.AddPersistentIfMissing(diskGpt, &persistent[i], align)
 	}
 	for _, p := range imageGpt.Partitions {
 		if !p.IsEmpty() {
-			if e := partition.AddFindSpace(diskGpt, &p, partition.Start); e != nil {
+			p, e := partition.Translate(p, imageGpt.SectorSize, diskGpt.SectorSize)
+			if e != nil {
+				return e
+			}
+			if e := partition.AddFindSpace(diskGpt, &p, partition.Start, align); e != nil {
 				return e
 			}
 		}
@@ -62,3 +69,55 @@ func MergeGpt(
 	}
 	return nil
 }
+
+// GrowPartitions grows the image partition matching the grow rules
+// into the free space after it in diskGpt, which must be the result of MergeGpt
+// with the same alignment.
+// It returns the grown partition and the number of blocks added to it,
+// or nil if no partition matches.
+// WARNING Modifies diskGpt (in memory)
+func GrowPartitions(
+	diskGpt *gpt.Table, imageGpt *gpt.Table, grow []*pb.FlashingConfig_GrowPartition, align uint64,
+) (*gpt.Partition, uint64, error) {
+	for _, g := range grow {
+		if g.PartUuid == "" && g.GptType == "" {
+			return nil, 0, fmt.Errorf("Grow rule needs a partition or type GUID.")
+		}
+	}
+	var target *gpt.Partition
+	var movable []gpt.Guid
+	for i := range imageGpt.Partitions {
+		p := &imageGpt.Partitions[i]
+		if p.IsEmpty() {
+			continue
+		}
+		matches := false
+		for _, g := range grow {
+			matches = matches || partition.MatchesGrow(p, g)
+		}
+		if !matches {
+			movable = append(movable, p.Id)
+			continue
+		}
+		if target != nil {
+			return nil, 0, fmt.Errorf(
+				"Partitions %v and %v both match grow rules, only one can grow.",
+				target.Id.String(), p.Id.String(),
+			)
+		}
+		target = p
+	}
+	if target == nil {
+		return nil, 0, nil
+	}
+	grown, e := partition.Grow(diskGpt, target.Id, movable, align)
+	if e != nil {
+		return nil, 0, e
+	}
+	for i := range diskGpt.Partitions {
+		if p := &diskGpt.Partitions[i]; !p.IsEmpty() && partition.EqGUID(p.Id, target.Id) {
+			return p, grown, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("Grown partition %v not found.", target.Id.String())
+}
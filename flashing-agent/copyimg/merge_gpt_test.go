@@ -43,7 +43,10 @@ func TestMergeGpt(t *testing.T) {
 			gpt.Table{
 				SectorSize: 512,
 				Header:     gpt.Header{FirstUsableLBA: 8, LastUsableLBA: 150},
-				Partitions: []gpt.Partition{},
+				Partitions: []gpt.Partition{
+					{FirstLBA: 9, LastLBA: 10,
+						Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+				},
 			},
 			[]pb.FlashingConfig_Partition{},
 			true, "sector size",
@@ -241,7 +244,7 @@ func TestMergeGpt(t *testing.T) {
 		},
 	}
 	for i, c := range cases {
-		e := copyimg.MergeGpt(&c.diskGpt, &c.imageGpt, c.persistent)
+		e := copyimg.MergeGpt(&c.diskGpt, &c.imageGpt, c.persistent, 1)
 		if c.shouldFail {
 			if e == nil {
 				t.Errorf("Test case %v: Excpected error, but none occured", i)
@@ -268,3 +271,184 @@ func TestMergeGpt(t *testing.T) {
 		}
 	}
 }
+
+func TestGrowPartitions(t *testing.T) {
+	persistent := []pb.FlashingConfig_Partition{
+		{PartUuid: testUuidStrings[1], Size: 2048, GptType: testUuidStrings[2]},
+	}
+	imageGpt := gpt.Table{
+		SectorSize: 1024,
+		Header:     gpt.Header{FirstUsableLBA: 8, LastUsableLBA: 150},
+		Partitions: []gpt.Partition{
+			{FirstLBA: 10, LastLBA: 20,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 21, LastLBA: 23,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		},
+	}
+	var cases = []struct {
+		label         string
+		grow          []*pb.FlashingConfig_GrowPartition
+		expGrown      uint64
+		shouldContain string
+		remaining     []gpt.Partition
+	}{
+		{"no rules", nil, 0, "", []gpt.Partition{
+			{FirstLBA: 199, LastLBA: 200,
+				Id: testUuids[1], Type: gpt.PartType(testUuids[2])},
+			{FirstLBA: 5, LastLBA: 15,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 16, LastLBA: 18,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		}},
+		{"match by type", []*pb.FlashingConfig_GrowPartition{
+			{GptType: strings.ToUpper(testUuidStrings[1])},
+		}, 180, "", []gpt.Partition{
+			{FirstLBA: 199, LastLBA: 200,
+				Id: testUuids[1], Type: gpt.PartType(testUuids[2])},
+			{FirstLBA: 5, LastLBA: 195,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 196, LastLBA: 198,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		}},
+		{"match by id", []*pb.FlashingConfig_GrowPartition{
+			{PartUuid: testUuidStrings[4]},
+		}, 180, "", []gpt.Partition{
+			{FirstLBA: 199, LastLBA: 200,
+				Id: testUuids[1], Type: gpt.PartType(testUuids[2])},
+			{FirstLBA: 5, LastLBA: 15,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 16, LastLBA: 198,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		}},
+		{"several matches", []*pb.FlashingConfig_GrowPartition{
+			{PartUuid: testUuidStrings[3]}, {PartUuid: testUuidStrings[4]},
+		}, 0, "only one", nil},
+		{"empty rule", []*pb.FlashingConfig_GrowPartition{{}}, 0, "needs", nil},
+	}
+	for _, c := range cases {
+		diskGpt := gpt.Table{
+			SectorSize: 1024,
+			Header:     gpt.Header{FirstUsableLBA: 5, LastUsableLBA: 200},
+			Partitions: make([]gpt.Partition, 3),
+		}
+		if e := copyimg.MergeGpt(&diskGpt, &imageGpt, persistent, 1); e != nil {
+			t.Fatalf("%v: unexpected error while merging: %v", c.label, e)
+		}
+		p, grown, e := copyimg.GrowPartitions(&diskGpt, &imageGpt, c.grow, 1)
+		if c.shouldContain != "" {
+			if e == nil || !strings.Contains(e.Error(), c.shouldContain) {
+				t.Errorf("%v: got error %v, want error containing %q", c.label, e, c.shouldContain)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%v: unexpected error: %v", c.label, e)
+			continue
+		}
+		if grown != c.expGrown || (p == nil) != (c.expGrown == 0) {
+			t.Errorf("%v: grew %+v by %v blocks, want %v", c.label, p, grown, c.expGrown)
+		}
+		for j, p := range diskGpt.Partitions {
+			if exp := c.remaining[j]; !matchesEnough(&exp, &p) {
+				t.Errorf("%v: partition %v is %+v, want %+v", c.label, j, p, exp)
+			}
+		}
+	}
+}
+
+func TestMergeGptAligned(t *testing.T) {
+	diskGpt := gpt.Table{
+		SectorSize: 512,
+		Header:     gpt.Header{FirstUsableLBA: 34, LastUsableLBA: 9966},
+		Partitions: make([]gpt.Partition, 4),
+	}
+	imageGpt := gpt.Table{
+		SectorSize: 512,
+		Header:     gpt.Header{FirstUsableLBA: 34, LastUsableLBA: 500},
+		Partitions: []gpt.Partition{
+			{FirstLBA: 34, LastLBA: 99,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 100, LastLBA: 199,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		},
+	}
+	persistent := []pb.FlashingConfig_Partition{
+		{PartUuid: testUuidStrings[1], Size: 3 * 512, GptType: testUuidStrings[2]},
+	}
+	if e := copyimg.MergeGpt(&diskGpt, &imageGpt, persistent, 2048); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	exp := []gpt.Partition{
+		{FirstLBA: 8192, LastLBA: 8194,
+			Id: testUuids[1], Type: gpt.PartType(testUuids[2])},
+		{FirstLBA: 2048, LastLBA: 2113,
+			Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+		{FirstLBA: 4096, LastLBA: 4195,
+			Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		{},
+	}
+	for j, p := range diskGpt.Partitions {
+		if !matchesEnough(&exp[j], &p) {
+			t.Errorf("partition %v is %+v, want %+v", j, p, exp[j])
+		}
+	}
+
+	// Copy tasks write to the aligned destinations.
+	tasks, e := copyimg.PlanFromGPTs(&diskGpt, &imageGpt)
+	if e != nil {
+		t.Fatalf("unexpected error while planning: %v", e)
+	}
+	expTasks := []copyimg.Task{
+		{Src: 34 * 512, Dst: 2048 * 512, Size: 66 * 512},
+		{Src: 100 * 512, Dst: 4096 * 512, Size: 100 * 512},
+	}
+	if len(tasks) != len(expTasks) || tasks[0] != expTasks[0] || tasks[1] != expTasks[1] {
+		t.Errorf("got tasks %+v, want %+v", tasks, expTasks)
+	}
+}
+
+func TestMergeGptTranslated(t *testing.T) {
+	// A 512 byte sector image on a 4Kn disk.
+	diskGpt := gpt.Table{
+		SectorSize: 4096,
+		Header:     gpt.Header{FirstUsableLBA: 6, LastUsableLBA: 1000},
+		Partitions: make([]gpt.Partition, 2),
+	}
+	imageGpt := gpt.Table{
+		SectorSize: 512,
+		Header:     gpt.Header{FirstUsableLBA: 34, LastUsableLBA: 500},
+		Partitions: []gpt.Partition{
+			{FirstLBA: 40, LastLBA: 119,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 120, LastLBA: 135,
+				Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+		},
+	}
+	if e := copyimg.MergeGpt(&diskGpt, &imageGpt, nil, 8); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	exp := []gpt.Partition{
+		{FirstLBA: 8, LastLBA: 17,
+			Id: testUuids[3], Type: gpt.PartType(testUuids[1])},
+		{FirstLBA: 24, LastLBA: 25,
+			Id: testUuids[4], Type: gpt.PartType(testUuids[2])},
+	}
+	for j, p := range diskGpt.Partitions {
+		if !matchesEnough(&exp[j], &p) {
+			t.Errorf("partition %v is %+v, want %+v", j, p, exp[j])
+		}
+	}
+
+	tasks, e := copyimg.PlanFromGPTs(&diskGpt, &imageGpt)
+	if e != nil {
+		t.Fatalf("unexpected error while planning: %v", e)
+	}
+	expTasks := []copyimg.Task{
+		{Src: 40 * 512, Dst: 8 * 4096, Size: 80 * 512},
+		{Src: 120 * 512, Dst: 24 * 4096, Size: 16 * 512},
+	}
+	if len(tasks) != len(expTasks) || tasks[0] != expTasks[0] || tasks[1] != expTasks[1] {
+		t.Errorf("got tasks %+v, want %+v", tasks, expTasks)
+	}
+}
@@ -0,0 +1,112 @@
+package copyimg
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Destination is one of the targets of CopyMulti.
+type Destination struct {
+	W     io.WriteSeeker
+	Tasks []Task
+	Opts  Options
+}
+
+// errDestDone is used to close the pipe of a destination which
+// does not need more data from the source.
+var errDestDone = errors.New("destination is done")
+
+// CopyToSeekers is like CopyToSeeker, but reads src only once and copies
+// dstTasks[i] to dsts[i]. The progress of all destinations is sent
+// on the same channel.
+func CopyToSeekers(dsts []io.WriteSeeker, src io.Reader, dstTasks [][]Task, progress chan<- uint64) error {
+	d := make([]Destination, len(dsts))
+	for i := range dsts {
+		d[i] = Destination{W: dsts[i], Tasks: dstTasks[i]}
+	}
+	return CopyMulti(d, src, progress)
+}
+
+// CopyMulti is like Copy, but reads src only once and copies to all
+// destinations concurrently, each with its own tasks and options.
+// The slowest destination limits the speed of all others.
+// If copying to one destination fails, all others fail too.
+func CopyMulti(dsts []Destination, src io.Reader, progress chan<- uint64) error {
+	if len(dsts) == 1 {
+		return Copy(dsts[0].W, src, dsts[0].Tasks, progress, dsts[0].Opts)
+	}
+	defer close(progress)
+
+	readers := make([]*io.PipeReader, len(dsts))
+	writers := make([]*io.PipeWriter, len(dsts))
+	for i := range dsts {
+		readers[i], writers[i] = io.Pipe()
+	}
+	errs := make([]error, len(dsts))
+	var wg sync.WaitGroup
+	for i, d := range dsts {
+		p := make(chan uint64)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := range p {
+				progress <- n
+			}
+		}()
+		go func(i int, d Destination) {
+			defer wg.Done()
+			errs[i] = Copy(d.W, readers[i], d.Tasks, p, d.Opts)
+			if errs[i] != nil {
+				readers[i].CloseWithError(errs[i])
+			} else {
+				readers[i].CloseWithError(errDestDone)
+			}
+		}(i, d)
+	}
+
+	teeErr := tee(src, writers)
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return teeErr
+}
+
+// tee copies src to all writers until each of them was closed with
+// errDestDone. If writing fails otherwise, or reading src fails,
+// all writers are closed with the error.
+func tee(src io.Reader, writers []*io.PipeWriter) error {
+	active := make([]*io.PipeWriter, len(writers))
+	copy(active, writers)
+	buf := make([]byte, defaultBufferSize)
+	var err error
+	for len(active) > 0 && err == nil {
+		n, e := src.Read(buf)
+		for i := 0; i < len(active) && n > 0; {
+			if _, we := active[i].Write(buf[:n]); we == errDestDone {
+				active = append(active[:i], active[i+1:]...)
+				continue
+			} else if we != nil {
+				err = we
+				break
+			}
+			i++
+		}
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			err = e
+		}
+	}
+	for _, w := range active {
+		if err != nil {
+			w.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package copyimg_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+)
+
+func TestCopyToSeekers(t *testing.T) {
+	srcData := make([]byte, 3*1024*1024+17)
+	for i := range srcData {
+		srcData[i] = byte(i * 13)
+	}
+	size := uint64(len(srcData))
+	dstTasks := [][]copyimg.Task{
+		{{Src: 0, Dst: 0, Size: 100}, {Src: 1000, Dst: 200, Size: size - 1000}},
+		{{Src: 0, Dst: 500, Size: 100}, {Src: 1000, Dst: 700, Size: size - 1000}},
+		{{Src: 50, Dst: 0, Size: 10}},
+	}
+	var dsts []io.WriteSeeker
+	var bufs []*WritableBuf
+	for range dstTasks {
+		b := NewWB(make([]byte, size))
+		bufs = append(bufs, b)
+		dsts = append(dsts, b)
+	}
+
+	progC := make(chan uint64)
+	progDone := make(chan uint64)
+	go func() {
+		var total uint64
+		for n := range progC {
+			total += n
+		}
+		progDone <- total
+	}()
+	if e := copyimg.CopyToSeekers(dsts, bytes.NewReader(srcData), dstTasks, progC); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	var expTotal uint64
+	for i, tasks := range dstTasks {
+		exp := make([]byte, size)
+		for _, task := range tasks {
+			copy(exp[task.Dst:task.Dst+task.Size], srcData[task.Src:task.Src+task.Size])
+			expTotal += task.Size
+		}
+		if !bytes.Equal(bufs[i].buf, exp) {
+			t.Errorf("destination %v: got %v..., want %v...", i,
+				hex.EncodeToString(bufs[i].buf[:16]), hex.EncodeToString(exp[:16]))
+		}
+	}
+	if total := <-progDone; total != expTotal {
+		t.Errorf("got progress of %v bytes, want %v", total, expTotal)
+	}
+}
+
+func TestCopyToSeekersErrors(t *testing.T) {
+	srcData := make([]byte, 1024)
+	dsts := []io.WriteSeeker{NewWB(make([]byte, 1024)), NewWB(make([]byte, 1024))}
+	cases := []struct {
+		label    string
+		dstTasks [][]copyimg.Task
+	}{
+		{"one destination out of range", [][]copyimg.Task{
+			{{Src: 0, Dst: 0, Size: 1024}},
+			{{Src: 0, Dst: 512, Size: 1024}},
+		}},
+		{"source too short", [][]copyimg.Task{
+			{{Src: 0, Dst: 0, Size: 10}},
+			{{Src: 1000, Dst: 0, Size: 100}},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			progC := make(chan uint64)
+			go func() {
+				for range progC {
+				}
+			}()
+			if e := copyimg.CopyToSeekers(dsts, bytes.NewReader(srcData), c.dstTasks, progC); e == nil {
+				t.Errorf("got no error, want some error")
+			}
+		})
+	}
+}
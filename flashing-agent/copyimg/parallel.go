@@ -0,0 +1,125 @@
+package copyimg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// CopyParallel is like Copy, but reads the source regions of tasks with n
+// concurrent readers using src.ReadAt (eg. one HTTP Range request per call).
+// Each task is written to dst as its data arrives, so tasks complete in no
+// particular order. Every reader reads opts.BufferSize bytes at once.
+// opts.BufferCount is ignored.
+func CopyParallel(
+	dst io.WriteSeeker, src io.ReaderAt, unsortedTasks []Task, n int, progress chan<- uint64, opts Options,
+) error {
+	defer close(progress)
+
+	if n < 1 {
+		return fmt.Errorf("got %v readers, want at least 1", n)
+	}
+	if opts.Sums != nil && len(opts.Sums) != len(unsortedTasks) {
+		return fmt.Errorf("got %v checksum slots for %v tasks", len(opts.Sums), len(unsortedTasks))
+	}
+	var dstMu sync.Mutex
+	copiers := make([]*copier, n)
+	for i := range copiers {
+		copiers[i] = newCopier(dst, nil, opts)
+		copiers[i].dstMu = &dstMu
+	}
+	if e := copiers[0].checkOptions(); e != nil {
+		return e
+	}
+	if opts.Stats != nil {
+		defer func() {
+			var s Stats
+			for _, c := range copiers {
+				s.Written += c.stats.Written
+				s.Zeroed += c.stats.Zeroed
+				s.Skipped += c.stats.Skipped
+			}
+			*opts.Stats = s
+		}()
+	}
+
+	tasks, e := sortTasks(unsortedTasks)
+	if e != nil {
+		return e
+	}
+
+	// Tasks are handed out in source order, so that reads
+	// are roughly sequential even with many readers.
+	jobs := make(chan int)
+	quit := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for i := range tasks.d {
+			select {
+			case jobs <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, n)
+	for _, c := range copiers {
+		go func(c *copier) {
+			errs <- c.copyTasksAt(src, tasks, jobs, progress)
+		}(c)
+	}
+	var first error
+	for range copiers {
+		if e := <-errs; e != nil && first == nil {
+			first = e
+			close(quit)
+		}
+	}
+	return first
+}
+
+// copyTasksAt copies the tasks whose indexes are received from jobs,
+// reading their data from src at the source offsets of the tasks.
+func (c *copier) copyTasksAt(src io.ReaderAt, tasks tasks, jobs <-chan int, progress chan<- uint64) error {
+	buf := alignedBuffer(c.opts.BufferSize)
+	bs := uint64(len(buf))
+	for i := range jobs {
+		t := tasks.d[i]
+		var h hash.Hash
+		if c.opts.Sums != nil {
+			h = sha256.New()
+		}
+		end := t.Dst + t.Size
+		for off := t.Dst; off < end; {
+			n := bs - off%bs
+			if off+n > end {
+				n = end - off
+			}
+			b := buf[:n]
+			if m, e := src.ReadAt(b, int64(t.Src+(off-t.Dst))); m < len(b) {
+				if e == io.EOF {
+					e = io.ErrUnexpectedEOF
+				}
+				return e
+			}
+			if h != nil {
+				h.Write(b)
+			}
+			if e := c.writeData(off, b); e != nil {
+				return e
+			}
+			off += n
+		}
+		if e := c.finishTask(t); e != nil {
+			return e
+		}
+		if h != nil {
+			h.Sum(c.opts.Sums[tasks.idx[i]][:0])
+		}
+		progress <- t.Size
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package copyimg_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+)
+
+func TestCopyParallel(t *testing.T) {
+	srcData := make([]byte, 200)
+	for i := range srcData {
+		if i%40 >= 20 {
+			srcData[i] = byte(i*7 + 1)
+		}
+	}
+	tasks := copyimg.SplitTasks([]copyimg.Task{
+		{Src: 150, Dst: 3, Size: 50},
+		{Src: 5, Dst: 64, Size: 97},
+		{Src: 102, Dst: 170, Size: 0},
+		{Src: 110, Dst: 180, Size: 20},
+	}, 20)
+	exp := bytes.Repeat([]byte{0xEE}, 210)
+	var total uint64
+	for _, task := range tasks {
+		copy(exp[task.Dst:], srcData[task.Src:task.Src+task.Size])
+		total += task.Size
+	}
+
+	cases := []struct {
+		n        int
+		zeroMode copyimg.ZeroMode
+	}{
+		{1, copyimg.WriteZeros},
+		{3, copyimg.WriteZeros},
+		{50, copyimg.WriteZeros},
+		{4, copyimg.SkipZeros},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%v readers, zero mode %v", c.n, c.zeroMode), func(t *testing.T) {
+			dst := NewWB(bytes.Repeat([]byte{0xEE}, 210))
+			if c.zeroMode == copyimg.SkipZeros {
+				copy(dst.buf, bytes.Repeat([]byte{0x00}, 210))
+				for i := range exp {
+					if exp[i] == 0xEE {
+						dst.buf[i] = 0xEE
+					}
+				}
+			}
+			progC := make(chan uint64, len(tasks))
+			sums := make([]copyimg.Checksum, len(tasks))
+			var stats copyimg.Stats
+			opts := copyimg.Options{
+				Sums:          sums,
+				ZeroMode:      c.zeroMode,
+				ZeroBlockSize: 4,
+				BufferSize:    8,
+				Stats:         &stats,
+			}
+			if e := copyimg.CopyParallel(dst, bytes.NewReader(srcData), tasks, c.n, progC, opts); e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(dst.buf, exp) {
+				t.Errorf("got %v, want %v", hex.EncodeToString(dst.buf), hex.EncodeToString(exp))
+			}
+			var progTot uint64
+			var progCount int
+			for v := range progC {
+				progTot += v
+				progCount++
+			}
+			if progCount != len(tasks) || progTot != total {
+				t.Errorf("got %v progress messages for %v bytes, want %v for %v bytes",
+					progCount, progTot, len(tasks), total)
+			}
+			if statsTot := stats.Written + stats.Zeroed + stats.Skipped; statsTot != total {
+				t.Errorf("got stats for %v bytes (%+v), want %v bytes", statsTot, stats, total)
+			}
+			if bad, e := copyimg.Verify(NewWB(exp), tasks, sums); e != nil || len(bad) != 0 {
+				t.Errorf("got checksum mismatches %v (error: %v), want none", bad, e)
+			}
+		})
+	}
+}
+
+func TestCopyParallelErrors(t *testing.T) {
+	cases := []struct {
+		label string
+		tasks []copyimg.Task
+		n     int
+	}{
+		{"overlapping src", []copyimg.Task{{Src: 0, Dst: 0, Size: 3}, {Src: 2, Dst: 5, Size: 1}}, 2},
+		{"overlapping dst", []copyimg.Task{{Src: 0, Dst: 0, Size: 3}, {Src: 4, Dst: 2, Size: 1}}, 2},
+		{"src out of range", []copyimg.Task{{Src: 0, Dst: 0, Size: 2}, {Src: 5, Dst: 2, Size: 4}}, 2},
+		{"dst out of range", []copyimg.Task{{Src: 0, Dst: 0, Size: 2}, {Src: 2, Dst: 6, Size: 4}}, 2},
+		{"no readers", []copyimg.Task{{Src: 0, Dst: 0, Size: 2}}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			progC := make(chan uint64, len(c.tasks))
+			dst := NewWB(make([]byte, 8))
+			e := copyimg.CopyParallel(dst, bytes.NewReader(make([]byte, 8)), c.tasks, c.n, progC, copyimg.Options{})
+			if e == nil {
+				t.Errorf("got no error, want some error")
+			}
+			for range progC {
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package copyimg
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
+
+const (
+	defaultBufferSize  = 4 * 1024 * 1024
+	defaultBufferCount = 4
+
+	// bufferAlign is the memory alignment of all buffers, which is
+	// enough for writing them to files opened with O_DIRECT.
+	bufferAlign = 4096
+)
+
+// chunk is a part of a task which was read into a buffer.
+type chunk struct {
+	buf  []byte // whole buffer, which is returned to the pool after writing
+	data []byte // part of buf which contains data
+	dst  uint64 // destination offset of data
+	task int    // index into the sorted tasks
+	last bool   // whether this is the last chunk of the task
+}
+
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+bufferAlign)
+	o := int(uintptr(unsafe.Pointer(&b[0])) & (bufferAlign - 1))
+	if o != 0 {
+		o = bufferAlign - o
+	}
+	return b[o : o+size : o+size]
+}
+
+// run copies the sorted tasks. One goroutine reads the source into buffers
+// from a bounded pool, while the calling goroutine writes full buffers to
+// the destination, so reading and writing don't wait for each other.
+// sumIdx[i] is the index in opts.Sums for tasks[i].
+func (c *copier) run(tasks []Task, sumIdx []int, progress chan<- uint64) error {
+	c.free = make(chan []byte, c.opts.BufferCount)
+	for i := 0; i < c.opts.BufferCount; i++ {
+		c.free <- alignedBuffer(c.opts.BufferSize)
+	}
+	chunks := make(chan chunk, c.opts.BufferCount)
+	quit := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.read(tasks, chunks, quit)
+	}()
+
+	writeErr := c.writeChunks(tasks, sumIdx, chunks, progress)
+	if writeErr != nil {
+		close(quit)
+		for range chunks {
+		}
+	}
+	if e := <-readErr; e != nil && writeErr == nil {
+		return e
+	}
+	return writeErr
+}
+
+// read reads the data of all tasks from the source and sends it to chunks.
+// Chunk boundaries inside of tasks are aligned to the buffer size relative
+// to the destination, so that writes stay aligned.
+func (c *copier) read(tasks []Task, chunks chan<- chunk, quit <-chan struct{}) error {
+	defer close(chunks)
+	bs := uint64(c.opts.BufferSize)
+	var pos uint64
+	for i, t := range tasks {
+		if _, e := io.CopyN(ioutil.Discard, c.src, int64(t.Src-pos)); e != nil {
+			return e
+		}
+		pos = t.Src
+
+		end := t.Dst + t.Size
+		for off := t.Dst; ; {
+			var buf []byte
+			select {
+			case buf = <-c.free:
+			case <-quit:
+				return nil
+			}
+			n := bs - off%bs
+			if off+n > end {
+				n = end - off
+			}
+			if _, e := io.ReadFull(c.src, buf[:n]); e != nil {
+				return e
+			}
+			pos += n
+			ch := chunk{buf: buf, data: buf[:n], dst: off, task: i, last: off+n == end}
+			select {
+			case chunks <- ch:
+			case <-quit:
+				return nil
+			}
+			off += n
+			if off == end {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// writeChunks writes all chunks to the destination and reports progress
+// after the last chunk of each task.
+func (c *copier) writeChunks(tasks []Task, sumIdx []int, chunks <-chan chunk, progress chan<- uint64) error {
+	var h hash.Hash
+	for ch := range chunks {
+		t := tasks[ch.task]
+		if ch.dst == t.Dst && c.opts.Sums != nil {
+			h = sha256.New()
+		}
+		if h != nil {
+			h.Write(ch.data)
+		}
+		e := c.writeData(ch.dst, ch.data)
+		c.free <- ch.buf
+		if e != nil {
+			return e
+		}
+		if !ch.last {
+			continue
+		}
+		if e := c.finishTask(t); e != nil {
+			return e
+		}
+		if h != nil {
+			h.Sum(c.opts.Sums[sumIdx[ch.task]][:0])
+			h = nil
+		}
+		progress <- t.Size
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package copyimg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// ZeroMode selects how Copy handles blocks which only contain zeros.
+type ZeroMode int
+
+const (
+	// WriteZeros writes zero blocks like any other data.
+	WriteZeros ZeroMode = iota
+	// ZeroOut sets zero blocks using Zeroer, if the destination implements it.
+	// If it does not, or if it does not support zeroing, zero blocks are written normally.
+	ZeroOut
+	// SkipZeros does not write zero blocks at all. This is only correct
+	// if the destination already contains zeros, eg. after being discarded.
+	SkipZeros
+)
+
+// defaultZeroBlockSize is used when Options.ZeroBlockSize is 0.
+const defaultZeroBlockSize = 64 * 1024
+
+// defaultSectorSize is used when Options.SectorSize is 0.
+const defaultSectorSize = 512
+
+// Zeroer is implemented by destinations which can set a range to zeros
+// without the zeros being written, eg. block devices supporting BLKZEROOUT.
+// Offset and length are multiples of Options.SectorSize. If zeroing is not
+// supported, ZeroRange returns syscall.EOPNOTSUPP or syscall.ENOTTY.
+type Zeroer interface {
+	ZeroRange(offset uint64, length uint64) error
+}
+
+// Stats counts how the bytes of all tasks were transferred to the destination.
+type Stats struct {
+	Written uint64 // bytes written normally
+	Zeroed  uint64 // bytes set to zero using Zeroer
+	Skipped uint64 // bytes not written, since the destination was assumed to contain them already
+}
+
+// copier holds the state of a single Copy call.
+type copier struct {
+	dst     io.WriteSeeker
+	src     io.Reader
+	opts    Options
+	zeroer  Zeroer // nil if not available
+	zeros   []byte
+	free    chan []byte // pool of empty buffers
+	zeroLen uint64      // length of the pending zero range, which ends at the next write
+	dstMu   *sync.Mutex // held while using dst if it is shared, nil otherwise
+	stats   Stats
+}
+
+func newCopier(dst io.WriteSeeker, src io.Reader, opts Options) *copier {
+	c := &copier{dst: dst, src: src, opts: opts}
+	if z, ok := dst.(Zeroer); ok && opts.ZeroMode == ZeroOut {
+		c.zeroer = z
+	}
+	if c.opts.BufferSize == 0 {
+		c.opts.BufferSize = defaultBufferSize
+	}
+	if c.opts.BufferCount == 0 {
+		c.opts.BufferCount = defaultBufferCount
+	}
+	if c.opts.SectorSize == 0 {
+		c.opts.SectorSize = defaultSectorSize
+	}
+	if opts.ZeroMode != WriteZeros {
+		if c.opts.ZeroBlockSize == 0 {
+			c.opts.ZeroBlockSize = defaultZeroBlockSize
+		}
+		c.zeros = alignedBuffer(int(c.opts.ZeroBlockSize))
+	}
+	return c
+}
+
+// writeData writes data which belongs at the destination offset dst.
+// Zero blocks are not written immediately, but collected until the next
+// non-zero block or until finishTask is called.
+func (c *copier) writeData(dst uint64, data []byte) error {
+	if c.opts.ZeroMode == WriteZeros {
+		return c.write(dst, data)
+	}
+
+	// Blocks are aligned relative to the start of the destination, so that
+	// zero ranges line up with the blocks of the underlying device.
+	// Consecutive non-zero blocks are written together.
+	bs := c.opts.ZeroBlockSize
+	end := dst + uint64(len(data))
+	dataStart := dst // start of pending non-zero blocks
+	for off := dst; off < end; {
+		n := bs - off%bs
+		if off+n > end {
+			n = end - off
+		}
+		b := data[off-dst : off-dst+n]
+		if !bytes.Equal(b, c.zeros[:n]) {
+			if e := c.zero(off-c.zeroLen, c.zeroLen); e != nil {
+				return e
+			}
+			c.zeroLen = 0
+			off += n
+			continue
+		}
+		if dataStart < off {
+			if e := c.write(dataStart, data[dataStart-dst:off-dst]); e != nil {
+				return e
+			}
+		}
+		c.zeroLen += n
+		off += n
+		dataStart = off
+	}
+	if dataStart < end {
+		return c.write(dataStart, data[dataStart-dst:])
+	}
+	return nil
+}
+
+// finishTask handles zero blocks at the end of t.
+func (c *copier) finishTask(t Task) error {
+	end := t.Dst + t.Size
+	e := c.zero(end-c.zeroLen, c.zeroLen)
+	c.zeroLen = 0
+	return e
+}
+
+// zero makes sure that the destination range contains only zeros.
+func (c *copier) zero(offset uint64, length uint64) error {
+	if length == 0 {
+		return nil
+	}
+	if c.opts.ZeroMode == SkipZeros {
+		c.stats.Skipped += length
+		return nil
+	}
+	// Only whole sectors can be zeroed, the head and tail are written.
+	ss := c.opts.SectorSize
+	start := (offset + ss - 1) / ss * ss
+	end := (offset + length) / ss * ss
+	if c.zeroer != nil && start < end {
+		c.lockDst()
+		e := c.zeroer.ZeroRange(start, end-start)
+		c.unlockDst()
+		switch {
+		case e == nil:
+			c.stats.Zeroed += end - start
+			if e := c.writeZeros(offset, start-offset); e != nil {
+				return e
+			}
+			return c.writeZeros(end, offset+length-end)
+		case e == syscall.EOPNOTSUPP || e == syscall.ENOTTY:
+			// Fall back to writing zeros from now on.
+			c.zeroer = nil
+			if c.opts.OnZeroUnsupported != nil {
+				c.opts.OnZeroUnsupported(e)
+			}
+		default:
+			return fmt.Errorf("while zeroing %v bytes at %v: %v", end-start, start, e)
+		}
+	}
+	return c.writeZeros(offset, length)
+}
+
+// writeZeros writes zeros to a range of the destination.
+func (c *copier) writeZeros(offset uint64, length uint64) error {
+	for length > 0 {
+		n := uint64(len(c.zeros))
+		if n > length {
+			n = length
+		}
+		if e := c.write(offset, c.zeros[:n]); e != nil {
+			return e
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+func (c *copier) write(offset uint64, b []byte) error {
+	c.lockDst()
+	defer c.unlockDst()
+	if _, e := c.dst.Seek(int64(offset), io.SeekStart); e != nil {
+		return e
+	}
+	n, e := c.dst.Write(b)
+	c.stats.Written += uint64(n)
+	return e
+}
+
+func (c *copier) lockDst() {
+	if c.dstMu != nil {
+		c.dstMu.Lock()
+	}
+}
+
+func (c *copier) unlockDst() {
+	if c.dstMu != nil {
+		c.dstMu.Unlock()
+	}
+}
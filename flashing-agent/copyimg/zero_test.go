@@ -0,0 +1,175 @@
+package copyimg_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+)
+
+type zeroCall struct {
+	offset uint64
+	length uint64
+}
+
+// ZeroingBuf is a WritableBuf which implements copyimg.Zeroer.
+type ZeroingBuf struct {
+	*WritableBuf
+	calls []zeroCall
+	err   error // returned by ZeroRange if not nil
+}
+
+func (t *ZeroingBuf) ZeroRange(offset uint64, length uint64) error {
+	t.calls = append(t.calls, zeroCall{offset, length})
+	if t.err != nil {
+		return t.err
+	}
+	for i := offset; i < offset+length; i++ {
+		t.buf[i] = 0
+	}
+	return nil
+}
+
+func TestCopyZeroModes(t *testing.T) {
+	srcData := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	dstOrigData := bytes.Repeat([]byte{0xEE}, len(srcData))
+	tasks := []copyimg.Task{
+		{Src: 0, Dst: 0, Size: 22},
+	}
+	copied := append(append([]byte{}, srcData[:22]...), dstOrigData[22:]...)
+	skipped := []byte{
+		0xEE, 0xEE, 0xEE, 0xEE, 0x01, 0x02, 0x03, 0x04,
+		0xEE, 0xEE, 0xEE, 0xEE, 0xEE, 0xEE, 0xEE, 0xEE,
+		0x00, 0x00, 0x05, 0x00, 0xEE, 0xEE, 0xEE, 0xEE,
+	}
+
+	cases := []struct {
+		label         string
+		mode          copyimg.ZeroMode
+		zeroer        bool
+		zeroerErr     error
+		exp           []byte
+		expCalls      []zeroCall
+		expStats      copyimg.Stats
+		expUnsupports int // calls of OnZeroUnsupported
+	}{
+		{"write zeros", copyimg.WriteZeros, true, nil,
+			copied, nil, copyimg.Stats{Written: 22}, 0},
+		// The zero range at 20 is shorter than a sector, so it is written.
+		{"zero out", copyimg.ZeroOut, true, nil,
+			copied, []zeroCall{{0, 4}, {8, 8}}, copyimg.Stats{Written: 10, Zeroed: 12}, 0},
+		{"zero out (not supported by destination)", copyimg.ZeroOut, false, nil,
+			copied, nil, copyimg.Stats{Written: 22}, 0},
+		{"zero out (not supported by device)", copyimg.ZeroOut, true, syscall.EOPNOTSUPP,
+			copied, []zeroCall{{0, 4}}, copyimg.Stats{Written: 22}, 1},
+		{"skip zeros", copyimg.SkipZeros, true, nil,
+			skipped, nil, copyimg.Stats{Written: 8, Skipped: 14}, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			origCopy := make([]byte, len(dstOrigData))
+			copy(origCopy, dstOrigData)
+			zb := &ZeroingBuf{WritableBuf: NewWB(origCopy), err: c.zeroerErr}
+
+			var stats copyimg.Stats
+			var unsupports int
+			opts := copyimg.Options{
+				Sums:              make([]copyimg.Checksum, len(tasks)),
+				ZeroMode:          c.mode,
+				ZeroBlockSize:     4,
+				SectorSize:        4,
+				Stats:             &stats,
+				OnZeroUnsupported: func(e error) { unsupports++ },
+			}
+			progC := make(chan uint64, len(tasks))
+			var e error
+			if c.zeroer {
+				e = copyimg.Copy(zb, bytes.NewReader(srcData), tasks, progC, opts)
+			} else {
+				e = copyimg.Copy(zb.WritableBuf, bytes.NewReader(srcData), tasks, progC, opts)
+			}
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+
+			if act := zb.buf; !bytes.Equal(act, c.exp) {
+				t.Errorf("got %v, want %v", hex.EncodeToString(act), hex.EncodeToString(c.exp))
+			}
+			if !(reflect.DeepEqual(zb.calls, c.expCalls) || (len(zb.calls) == 0 && len(c.expCalls) == 0)) {
+				t.Errorf("got zeroing calls %v, want %v", zb.calls, c.expCalls)
+			}
+			if stats != c.expStats {
+				t.Errorf("got stats %+v, want %+v", stats, c.expStats)
+			}
+			if unsupports != c.expUnsupports {
+				t.Errorf("got %v calls of OnZeroUnsupported, want %v", unsupports, c.expUnsupports)
+			}
+			// Checksums always cover the source data, even for skipped blocks.
+			if bad, e := copyimg.Verify(NewWB(copied), tasks, opts.Sums); e != nil || len(bad) != 0 {
+				t.Errorf("got checksum mismatches %v (error: %v), want none", bad, e)
+			}
+		})
+	}
+}
+
+func TestCopyZeroBlockAlignment(t *testing.T) {
+	// Blocks are aligned to the destination, not to the source or the task.
+	srcData := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00}
+	dst := &ZeroingBuf{WritableBuf: NewWB(bytes.Repeat([]byte{0xEE}, 12))}
+	tasks := []copyimg.Task{{Src: 0, Dst: 2, Size: 10}}
+	opts := copyimg.Options{ZeroMode: copyimg.ZeroOut, ZeroBlockSize: 4, SectorSize: 1}
+	progC := make(chan uint64, len(tasks))
+	if e := copyimg.Copy(dst, bytes.NewReader(srcData), tasks, progC, opts); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	expCalls := []zeroCall{{2, 6}}
+	if !reflect.DeepEqual(dst.calls, expCalls) {
+		t.Errorf("got zeroing calls %v, want %v", dst.calls, expCalls)
+	}
+	exp := []byte{0xEE, 0xEE, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00}
+	if !bytes.Equal(dst.buf, exp) {
+		t.Errorf("got %v, want %v", hex.EncodeToString(dst.buf), hex.EncodeToString(exp))
+	}
+}
+
+func TestCopyZeroSectorAlignment(t *testing.T) {
+	// Zeros from 3 to 21, only the sectors 4-8, 8-12, 12-16 and 16-20 can be zeroed.
+	srcData := append(append([]byte{1, 2, 3}, make([]byte, 18)...), 4, 5, 6)
+	dst := &ZeroingBuf{WritableBuf: NewWB(bytes.Repeat([]byte{0xEE}, len(srcData)))}
+	tasks := []copyimg.Task{{Src: 0, Dst: 0, Size: uint64(len(srcData))}}
+	var stats copyimg.Stats
+	opts := copyimg.Options{ZeroMode: copyimg.ZeroOut, ZeroBlockSize: 1, SectorSize: 4, Stats: &stats}
+	progC := make(chan uint64, len(tasks))
+	if e := copyimg.Copy(dst, bytes.NewReader(srcData), tasks, progC, opts); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if expCalls := []zeroCall{{4, 16}}; !reflect.DeepEqual(dst.calls, expCalls) {
+		t.Errorf("got zeroing calls %v, want %v", dst.calls, expCalls)
+	}
+	if !bytes.Equal(dst.buf, srcData) {
+		t.Errorf("got %v, want %v", hex.EncodeToString(dst.buf), hex.EncodeToString(srcData))
+	}
+	if exp := (copyimg.Stats{Written: 8, Zeroed: 16}); stats != exp {
+		t.Errorf("got stats %+v, want %+v", stats, exp)
+	}
+}
+
+func TestCopyZeroError(t *testing.T) {
+	// Errors other than "not supported" are not hidden by writing zeros.
+	dst := &ZeroingBuf{WritableBuf: NewWB(bytes.Repeat([]byte{0xEE}, 8)), err: errors.New("I/O error")}
+	tasks := []copyimg.Task{{Src: 0, Dst: 0, Size: 8}}
+	opts := copyimg.Options{ZeroMode: copyimg.ZeroOut, ZeroBlockSize: 4, SectorSize: 4}
+	progC := make(chan uint64, len(tasks))
+	if e := copyimg.Copy(dst, bytes.NewReader(make([]byte, 8)), tasks, progC, opts); e == nil {
+		t.Errorf("got no error, want some error")
+	}
+}
@@ -0,0 +1,185 @@
+package delta_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/delta"
+	"github.com/rekby/gpt"
+)
+
+const blockSize = 4
+
+// testImage has 10 blocks, the last one is only 2 bytes long.
+var testImage = []byte("AAAABBBBCCCCDDDDEEEEFFFFGGGGHHHHIIIIJJ")
+
+func makeManifest(image []byte) string {
+	doc := fmt.Sprintf("image-size %v\nblock-size %v\n", len(image), blockSize)
+	for i := 0; i < len(image); i += blockSize {
+		end := i + blockSize
+		if end > len(image) {
+			end = len(image)
+		}
+		s := sha256.Sum256(image[i:end])
+		doc += hex.EncodeToString(s[:]) + "\n"
+	}
+	return doc
+}
+
+func TestParse(t *testing.T) {
+	m, e := delta.Parse(strings.NewReader(makeManifest(testImage)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if m.ImageSize != uint64(len(testImage)) || m.BlockSize != blockSize {
+		t.Errorf("got image size %v and block size %v", m.ImageSize, m.BlockSize)
+	}
+	if len(m.Sums) != 10 {
+		t.Errorf("got %v checksums, want 10", len(m.Sums))
+	}
+	if exp := sha256.Sum256([]byte("JJ")); m.Sums[9] != exp {
+		t.Errorf("got checksum %x for last block, want %x", m.Sums[9], exp)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := makeManifest(testImage)
+	cases := []struct {
+		label string
+		doc   string
+	}{
+		{"empty", ""},
+		{"missing block size", "image-size 38\n"},
+		{"headers swapped", strings.Replace(strings.Replace(valid,
+			"image-size", "x", 1), "block-size", "image-size", 1)},
+		{"zero block size", strings.Replace(valid, "block-size 4", "block-size 0", 1)},
+		{"too few checksums", strings.Replace(valid, "image-size 38", "image-size 41", 1)},
+		{"too many checksums", strings.Replace(valid, "image-size 38", "image-size 36", 1)},
+		{"bad checksum", valid + "1234\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			if _, e := delta.Parse(strings.NewReader(c.doc)); e == nil {
+				t.Errorf("got no error, want some error")
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	m, e := delta.Parse(strings.NewReader(makeManifest(testImage)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	// The disk contains the image at offset 100, except for blocks 2 and 7.
+	disk := bytes.Repeat([]byte{'.'}, 200)
+	copy(disk[100:], testImage)
+	copy(disk[108:], "cccc")
+	copy(disk[128:], "hhhh")
+
+	cases := []struct {
+		label   string
+		tasks   []copyimg.Task
+		exp     []copyimg.Task
+		expSame uint64
+	}{
+		{"whole image",
+			[]copyimg.Task{{Src: 0, Dst: 100, Size: 38}},
+			[]copyimg.Task{{Src: 8, Dst: 108, Size: 4}, {Src: 28, Dst: 128, Size: 4}},
+			30},
+		{"partial blocks at task edges",
+			[]copyimg.Task{{Src: 2, Dst: 102, Size: 20}},
+			[]copyimg.Task{{Src: 2, Dst: 102, Size: 2}, {Src: 8, Dst: 108, Size: 4}, {Src: 20, Dst: 120, Size: 2}},
+			12},
+		{"multiple tasks",
+			[]copyimg.Task{{Src: 4, Dst: 104, Size: 8}, {Src: 24, Dst: 124, Size: 14}},
+			[]copyimg.Task{{Src: 8, Dst: 108, Size: 4}, {Src: 28, Dst: 128, Size: 4}},
+			14},
+		{"moved destination",
+			[]copyimg.Task{{Src: 0, Dst: 0, Size: 8}},
+			[]copyimg.Task{{Src: 0, Dst: 0, Size: 8}},
+			0},
+		{"empty task",
+			[]copyimg.Task{{Src: 4, Dst: 104, Size: 0}},
+			nil,
+			0},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			act, same, e := m.Changed(bytes.NewReader(disk), c.tasks)
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if !reflect.DeepEqual(act, c.exp) {
+				t.Errorf("got tasks %v, want %v", act, c.exp)
+			}
+			if same != c.expSame {
+				t.Errorf("got %v unchanged bytes, want %v", same, c.expSame)
+			}
+		})
+	}
+
+	if _, _, e := m.Changed(bytes.NewReader(disk[:120]), []copyimg.Task{{Src: 0, Dst: 100, Size: 38}}); e == nil {
+		t.Errorf("got no error for short disk, want some error")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m, e := delta.Parse(strings.NewReader(makeManifest(testImage)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	disk := make([]byte, 100)
+	copy(disk[50:], testImage)
+	// Split in the middle of block 2, which is still checked.
+	tasks := []copyimg.Task{{Src: 2, Dst: 52, Size: 8}, {Src: 10, Dst: 60, Size: 28}}
+
+	bad, unchecked, e := m.Verify(bytes.NewReader(disk), tasks)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if bad != 0 || unchecked != 2 {
+		t.Errorf("got %v bad blocks and %v unchecked bytes, want 0 and 2", bad, unchecked)
+	}
+
+	copy(disk[58:], "cccc")
+	copy(disk[87:], "j")
+	if bad, _, e := m.Verify(bytes.NewReader(disk), tasks); e != nil || bad != 2 {
+		t.Errorf("got %v bad blocks and error %v, want 2 bad blocks", bad, e)
+	}
+}
+
+func TestUnmoved(t *testing.T) {
+	ids := []gpt.Guid{{1}, {2}, {3}}
+	typ := gpt.PartType{0xAA}
+	old := &gpt.Table{SectorSize: 512, Partitions: []gpt.Partition{
+		{Id: ids[0], Type: typ, FirstLBA: 10, LastLBA: 19},
+		{Id: ids[1], Type: typ, FirstLBA: 20, LastLBA: 29},
+		{Id: ids[2], Type: typ, FirstLBA: 30, LastLBA: 39},
+	}}
+	new := &gpt.Table{SectorSize: 512, Partitions: []gpt.Partition{
+		{Id: ids[0], Type: typ, FirstLBA: 10, LastLBA: 19},
+		{Id: ids[1], Type: typ, FirstLBA: 20, LastLBA: 34},
+		{Id: ids[2], Type: typ, FirstLBA: 35, LastLBA: 39},
+		{Id: gpt.Guid{4}, Type: typ, FirstLBA: 40, LastLBA: 49},
+	}}
+	tasks := []copyimg.Task{
+		{Src: 0, Dst: 10 * 512, Size: 10 * 512},
+		{Src: 0, Dst: 20 * 512, Size: 15 * 512},
+		{Src: 0, Dst: 35 * 512, Size: 5 * 512},
+		{Src: 0, Dst: 40 * 512, Size: 10 * 512},
+	}
+	unmoved, moved := delta.Unmoved(old, new, tasks)
+	if exp := tasks[:1]; !reflect.DeepEqual(unmoved, exp) {
+		t.Errorf("got unmoved tasks %v, want %v", unmoved, exp)
+	}
+	if exp := tasks[1:]; !reflect.DeepEqual(moved, exp) {
+		t.Errorf("got moved tasks %v, want %v", moved, exp)
+	}
+}
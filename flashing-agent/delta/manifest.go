@@ -0,0 +1,98 @@
+// Package delta supports flashing only the blocks of an image which
+// differ from what is already on the disk. The image is described by a
+// manifest, which lists the SHA-256 of every block of the image.
+//
+// A manifest is a text file. The first two lines contain the image size and
+// block size in bytes, followed by one hex encoded SHA-256 per block:
+//
+//	image-size 10485760
+//	block-size 1048576
+//	30e14955ebf1352266dc2ff8067e68104607e750abb9d3b36582b8af909fcb58
+//	...
+//
+// The last block is shorter than block-size if the image size is not a
+// multiple of it. Its checksum only covers the bytes in the image.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Manifest is a parsed block checksum manifest.
+type Manifest struct {
+	ImageSize uint64
+	BlockSize uint64
+	Sums      [][sha256.Size]byte // one per block
+}
+
+// Parse reads a manifest file.
+func Parse(r io.Reader) (*Manifest, error) {
+	s := bufio.NewScanner(r)
+	m := &Manifest{}
+	var e error
+	if m.ImageSize, e = parseHeader(s, "image-size"); e != nil {
+		return nil, e
+	}
+	if m.BlockSize, e = parseHeader(s, "block-size"); e != nil {
+		return nil, e
+	}
+	if m.BlockSize == 0 {
+		return nil, fmt.Errorf("invalid manifest block-size 0")
+	}
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		d, e := hex.DecodeString(l)
+		if e != nil || len(d) != sha256.Size {
+			return nil, fmt.Errorf("invalid manifest checksum for block %v: %q", len(m.Sums), l)
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], d)
+		m.Sums = append(m.Sums, sum)
+	}
+	if e := s.Err(); e != nil {
+		return nil, e
+	}
+	blocks := (m.ImageSize + m.BlockSize - 1) / m.BlockSize
+	if uint64(len(m.Sums)) != blocks {
+		return nil, fmt.Errorf("got %v manifest checksums for %v blocks", len(m.Sums), blocks)
+	}
+	return m, nil
+}
+
+// parseHeader reads a "<key> <value>" line with an unsigned integer value.
+func parseHeader(s *bufio.Scanner, key string) (uint64, error) {
+	if !s.Scan() {
+		if e := s.Err(); e != nil {
+			return 0, e
+		}
+		return 0, fmt.Errorf("manifest ends before %v", key)
+	}
+	f := strings.Fields(s.Text())
+	if len(f) != 2 || f[0] != key {
+		return 0, fmt.Errorf("got manifest line %q, want %v", s.Text(), key)
+	}
+	v, e := strconv.ParseUint(f[1], 10, 64)
+	if e != nil {
+		return 0, fmt.Errorf("invalid manifest %v: %v", key, e)
+	}
+	return v, nil
+}
+
+// blockRange returns the range of image bytes covered by block i.
+func (m *Manifest) blockRange(i uint64) (start uint64, end uint64) {
+	start = i * m.BlockSize
+	end = start + m.BlockSize
+	if end > m.ImageSize {
+		end = m.ImageSize
+	}
+	return start, end
+}
@@ -0,0 +1,113 @@
+package delta
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
+	"github.com/rekby/gpt"
+)
+
+// Changed reads the destination regions of tasks from dst and compares them
+// to the image blocks they would be copied from. It returns tasks which only
+// copy the blocks that differ, and the number of bytes which are already
+// up to date. Blocks which are only partly covered by a task can't be
+// compared, so they are always copied.
+func (m *Manifest) Changed(dst io.ReaderAt, tasks []copyimg.Task) ([]copyimg.Task, uint64, error) {
+	var out []copyimg.Task
+	var same uint64
+	add := func(t copyimg.Task, start uint64, end uint64) {
+		if start < end {
+			out = append(out, copyimg.Task{Src: start, Dst: t.Dst + (start - t.Src), Size: end - start})
+		}
+	}
+	buf := make([]byte, m.BlockSize)
+	for _, t := range tasks {
+		pos := t.Src // start of the data which has to be copied
+		e := m.compare(dst, t, buf, func(start uint64, end uint64, match bool) {
+			if match {
+				add(t, pos, start)
+				pos = end
+				same += end - start
+			}
+		})
+		if e != nil {
+			return nil, 0, e
+		}
+		add(t, pos, t.Src+t.Size)
+	}
+	return out, same, nil
+}
+
+// Verify compares the destination regions of tasks in dst to the image blocks
+// they were copied from. It returns the number of blocks which differ, and the
+// number of bytes which can't be checked because they are only part of a block.
+// Tasks which continue the previous one are merged first, so that splitting
+// tasks does not leave blocks unchecked.
+func (m *Manifest) Verify(dst io.ReaderAt, tasks []copyimg.Task) (int, uint64, error) {
+	var merged []copyimg.Task
+	for _, t := range tasks {
+		if l := len(merged) - 1; l >= 0 && merged[l].Src+merged[l].Size == t.Src &&
+			merged[l].Dst+merged[l].Size == t.Dst {
+			merged[l].Size += t.Size
+		} else {
+			merged = append(merged, t)
+		}
+	}
+	var bad int
+	var unchecked uint64
+	buf := make([]byte, m.BlockSize)
+	for _, t := range merged {
+		unchecked += t.Size
+		e := m.compare(dst, t, buf, func(start uint64, end uint64, match bool) {
+			unchecked -= end - start
+			if !match {
+				bad++
+			}
+		})
+		if e != nil {
+			return 0, 0, e
+		}
+	}
+	return bad, unchecked, nil
+}
+
+// compare calls f in order for every block which is completely covered by t,
+// with the range of image bytes of the block and whether dst contains it.
+func (m *Manifest) compare(dst io.ReaderAt, t copyimg.Task, buf []byte, f func(start uint64, end uint64, match bool)) error {
+	end := t.Src + t.Size
+	for b := (t.Src + m.BlockSize - 1) / m.BlockSize; b < uint64(len(m.Sums)); b++ {
+		start, bEnd := m.blockRange(b)
+		if bEnd > end {
+			break
+		}
+		p := buf[:bEnd-start]
+		if n, e := dst.ReadAt(p, int64(t.Dst+(start-t.Src))); n < len(p) {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return e
+		}
+		f(start, bEnd, sha256.Sum256(p) == m.Sums[b])
+	}
+	return nil
+}
+
+// Unmoved splits tasks by whether their destination is inside a partition
+// which has the same ID and location in the old and new tables (of the same
+// disk). Only those can still contain the data of a previous flash.
+func Unmoved(old *gpt.Table, new *gpt.Table, tasks []copyimg.Task) (unmoved []copyimg.Task, moved []copyimg.Task) {
+	for _, t := range tasks {
+		lba := t.Dst / new.SectorSize
+		n := partition.FindContaining(new, lba)
+		o := partition.FindContaining(old, lba)
+		if n != nil && o != nil && partition.EqGUID(n.Id, o.Id) &&
+			n.FirstLBA == o.FirstLBA && n.LastLBA == o.LastLBA {
+			unmoved = append(unmoved, t)
+		} else {
+			moved = append(moved, t)
+		}
+	}
+	return unmoved, moved
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rekby/gpt"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// wipeSize is the number of bytes zeroed at the start and end of every range
+// if the disk does not support discard. Filesystem signatures are found there.
+const wipeSize = 1 << 20
+
+// discardRanges returns the ranges of table to discard. If afterCopy is set,
+// the destinations of tasks are left out, since they hold image data by then.
+func discardRanges(
+	oldTable *gpt.Table, table *gpt.Table, pers []pb.FlashingConfig_Partition,
+	tasks []copyimg.Task, afterCopy bool,
+) ([]partition.LBARange, error) {
+	ranges, e := partition.DiscardRanges(oldTable, table, pers)
+	if e != nil {
+		return nil, e
+	}
+	if afterCopy {
+		for _, t := range tasks {
+			if t.Size > 0 {
+				ranges = partition.Exclude(ranges, t.Dst/table.SectorSize, (t.Dst+t.Size-1)/table.SectorSize)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// discard discards ranges of blocks on dev. If the disk does not support
+// the discard mode, the ranges are zeroed: for SECURE_DISCARD completely,
+// otherwise only wipeSize bytes at their start and end.
+func discard(
+	logger *superlog.Logger, dev disk.Device, ranges []partition.LBARange,
+	sectorSize uint64, mode pb.DiscardMode,
+) error {
+	var total uint64
+	fallback := false
+	for _, r := range ranges {
+		offset := r.FirstLBA * sectorSize
+		length := (r.LastLBA - r.FirstLBA + 1) * sectorSize
+		if !fallback {
+			var e error
+			if mode == pb.DiscardMode_SECURE_DISCARD {
+				e = dev.SecureDiscardRange(offset, length)
+			} else {
+				e = dev.DiscardRange(offset, length)
+			}
+			if disk.IsUnsupported(e) {
+				logger.Logf("WARNING: disk does not support %v, zeroing ranges instead", mode)
+				fallback = true
+			} else if e != nil {
+				return fmt.Errorf("while discarding %v bytes at %v: %v", length, offset, e)
+			}
+		}
+		if fallback {
+			if e := wipe(dev, offset, length, mode == pb.DiscardMode_SECURE_DISCARD); e != nil {
+				return fmt.Errorf("while zeroing %v bytes at %v: %v", length, offset, e)
+			}
+		}
+		logger.Logf("discarded LBA %v-%v (%v bytes at %v)", r.FirstLBA, r.LastLBA, length, offset)
+		total += length
+	}
+	logger.Logf("discarded %v bytes in %v ranges", total, len(ranges))
+	return nil
+}
+
+func wipe(dev disk.Device, offset uint64, length uint64, all bool) error {
+	if all || length <= 2*wipeSize {
+		return dev.WriteZeros(offset, length)
+	}
+	if e := dev.WriteZeros(offset, wipeSize); e != nil {
+		return e
+	}
+	return dev.WriteZeros(offset+length-wipeSize, wipeSize)
+}
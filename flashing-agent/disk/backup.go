@@ -0,0 +1,76 @@
+package disk
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rekby/gpt"
+)
+
+// Region is a range of raw bytes on a disk.
+type Region struct {
+	Offset uint64
+	Data   []byte
+}
+
+// GptRegions returns the byte ranges which writing table and a protective
+// MBR overwrites: the first sector, the primary GPT header and partition
+// entries, and the backup partition entries and header at the end of the disk.
+func GptRegions(table *gpt.Table) (offsets, lengths []uint64, err error) {
+	ss := table.SectorSize
+	h := &table.Header
+	entries := uint64(h.PartitionsArrLen)
+	if n := uint64(len(table.Partitions)); n > entries {
+		entries = n
+	}
+	entrySectors := (entries*uint64(h.PartitionEntrySize) + ss - 1) / ss
+	if h.PartitionsTableStartLBA < 2 || h.HeaderCopyStartLBA <= h.LastUsableLBA ||
+		h.PartitionsTableStartLBA+entrySectors > h.FirstUsableLBA {
+		return nil, nil, fmt.Errorf(
+			"unexpected GPT layout (entries at LBA %v, usable LBA %v-%v, backup header at LBA %v)",
+			h.PartitionsTableStartLBA, h.FirstUsableLBA, h.LastUsableLBA, h.HeaderCopyStartLBA,
+		)
+	}
+	offsets = []uint64{0, ss, (h.LastUsableLBA + 1) * ss}
+	lengths = []uint64{
+		ss,
+		(h.PartitionsTableStartLBA + entrySectors - 1) * ss,
+		(h.HeaderCopyStartLBA - h.LastUsableLBA) * ss,
+	}
+	return offsets, lengths, nil
+}
+
+// ReadGptRegions reads the regions returned by GptRegions from the disk.
+func ReadGptRegions(r io.ReaderAt, table *gpt.Table) ([]Region, error) {
+	offsets, lengths, e := GptRegions(table)
+	if e != nil {
+		return nil, e
+	}
+	out := make([]Region, len(offsets))
+	for i := range offsets {
+		out[i] = Region{Offset: offsets[i], Data: make([]byte, lengths[i])}
+		if _, e := r.ReadAt(out[i].Data, int64(offsets[i])); e != nil {
+			return nil, fmt.Errorf("while reading %v bytes at %v: %v", lengths[i], offsets[i], e)
+		}
+	}
+	return out, nil
+}
+
+// WriteRegions writes regions back to a disk of the given size.
+// Regions have to be whole sectors inside the disk.
+func WriteRegions(w io.WriterAt, regions []Region, sectorSizeBytes uint64, diskSizeBytes uint64) error {
+	for _, r := range regions {
+		l := uint64(len(r.Data))
+		if r.Offset%sectorSizeBytes != 0 || l%sectorSizeBytes != 0 ||
+			r.Offset > diskSizeBytes || l > diskSizeBytes-r.Offset {
+			return fmt.Errorf("invalid region of %v bytes at %v (disk: %v, sector: %v)",
+				l, r.Offset, diskSizeBytes, sectorSizeBytes)
+		}
+	}
+	for _, r := range regions {
+		if _, e := w.WriteAt(r.Data, int64(r.Offset)); e != nil {
+			return fmt.Errorf("while writing %v bytes at %v: %v", len(r.Data), r.Offset, e)
+		}
+	}
+	return nil
+}
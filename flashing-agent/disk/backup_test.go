@@ -0,0 +1,86 @@
+package disk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tehwalris/ghw"
+)
+
+func TestGptRegions(t *testing.T) {
+	table, e := createGpt(&ghw.Disk{SizeBytes: 8 << 20, SectorSizeBytes: 512})
+	if e != nil {
+		t.Fatal(e)
+	}
+	offsets, lengths, e := GptRegions(table)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	// 128 entries of 128 bytes take 32 sectors.
+	expOffsets := []uint64{0, 512, (16384 - 33) * 512}
+	expLengths := []uint64{512, 33 * 512, 33 * 512}
+	for i := range expOffsets {
+		if offsets[i] != expOffsets[i] || lengths[i] != expLengths[i] {
+			t.Errorf("region %v: expected %v bytes at %v, got %v bytes at %v",
+				i, expLengths[i], expOffsets[i], lengths[i], offsets[i])
+		}
+	}
+
+	table.Header.LastUsableLBA = table.Header.HeaderCopyStartLBA
+	if _, _, e := GptRegions(table); e == nil {
+		t.Errorf("expected error for invalid layout")
+	}
+}
+
+func TestBackupRestoreRegions(t *testing.T) {
+	f, e := ioutil.TempFile("", "disk")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size := uint64(8 << 20)
+	orig := make([]byte, size)
+	for i := range orig {
+		orig[i] = byte(i * 7)
+	}
+	if _, e := f.Write(orig); e != nil {
+		t.Fatal(e)
+	}
+
+	table, e := createGpt(&ghw.Disk{SizeBytes: size, SectorSizeBytes: 512})
+	if e != nil {
+		t.Fatal(e)
+	}
+	regions, e := ReadGptRegions(f, table)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if e := table.Write(f); e != nil {
+		t.Fatal(e)
+	}
+	if e := table.CreateOtherSideTable().Write(f); e != nil {
+		t.Fatal(e)
+	}
+	if e := WritePMBR(f, 512, size); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := WriteRegions(f, regions, 512, size); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	out, e := ioutil.ReadFile(f.Name())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(out, orig) {
+		t.Errorf("disk contents differ from before writing the GPT")
+	}
+
+	bad := []Region{{Offset: size - 512, Data: make([]byte, 1024)}}
+	if e := WriteRegions(f, bad, 512, size); e == nil {
+		t.Errorf("expected error for region past the end of the disk")
+	}
+}
@@ -75,7 +75,7 @@ func GetOrCreateGpt(
 	}
 	table, e := gpt.ReadTable(f, d.SectorSizeBytes)
 	if e != nil {
-		if e.Error() == "Bad GPT signature" {
+		if isNoGpt(e) {
 			// "Bad GPT signature" almost definitely means the disk is empty.
 			// This is the only case where a fresh GPT will be created.
 			// Other cases fail for safety.
@@ -89,3 +89,27 @@ func GetOrCreateGpt(
 	}
 	return &table, false, nil
 }
+
+// ReadGpt opens a disk read-only and loads its GPT. It returns nil if there is no GPT.
+func ReadGpt(d *ghw.Disk) (*gpt.Table, error) {
+	f, _, e := openDisk(d, true)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	if _, e := f.Seek(int64(d.SectorSizeBytes), io.SeekStart); e != nil {
+		return nil, e
+	}
+	table, e := gpt.ReadTable(f, d.SectorSizeBytes)
+	if e != nil {
+		if isNoGpt(e) {
+			return nil, nil
+		}
+		return nil, e
+	}
+	return &table, nil
+}
+
+func isNoGpt(e error) bool {
+	return e.Error() == "Bad GPT signature"
+}
@@ -0,0 +1,88 @@
+package disk
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux block device ioctl numbers (see linux/fs.h).
+const (
+	blkflsbuf  = 0x1261 // _IO(0x12, 97)
+	blkdiscard = 0x1277 // _IO(0x12, 119)
+	blksecdisc = 0x127D // _IO(0x12, 125)
+	blkzeroout = 0x127F // _IO(0x12, 127)
+)
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Device is an open block device.
+type Device struct {
+	*os.File
+}
+
+// ZeroRange sets a byte range of the device to zeros without transferring them (BLKZEROOUT).
+// Offset and length must be multiples of the logical sector size.
+// This fails for files which are not block devices.
+func (d Device) ZeroRange(offset uint64, length uint64) error {
+	r := [2]uint64{offset, length}
+	return ioctl(d.File, blkzeroout, unsafe.Pointer(&r))
+}
+
+// DiscardRange tells the device that a byte range is unused (BLKDISCARD).
+// What the range reads as afterwards depends on the device.
+// Offset and length must be multiples of the logical sector size.
+func (d Device) DiscardRange(offset uint64, length uint64) error {
+	r := [2]uint64{offset, length}
+	return ioctl(d.File, blkdiscard, unsafe.Pointer(&r))
+}
+
+// SecureDiscardRange discards a byte range like DiscardRange, and also
+// erases all copies of its data which the device may keep (BLKSECDISCARD).
+func (d Device) SecureDiscardRange(offset uint64, length uint64) error {
+	r := [2]uint64{offset, length}
+	return ioctl(d.File, blksecdisc, unsafe.Pointer(&r))
+}
+
+// WriteZeros sets a byte range to zeros, using ZeroRange if supported
+// and writing zeros otherwise.
+func (d Device) WriteZeros(offset uint64, length uint64) error {
+	e := d.ZeroRange(offset, length)
+	if !IsUnsupported(e) {
+		return e
+	}
+	buf := make([]byte, 1<<20)
+	for length > 0 {
+		n := uint64(len(buf))
+		if length < n {
+			n = length
+		}
+		if _, e := d.WriteAt(buf[:n], int64(offset)); e != nil {
+			return e
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// IsUnsupported returns whether e means that the device or file
+// does not support an ioctl.
+func IsUnsupported(e error) bool {
+	return e == syscall.EOPNOTSUPP || e == syscall.ENOTTY
+}
+
+// FlushCache writes all cached data to the disk and drops the kernel's buffer cache
+// for it, so that following reads return what is actually stored on the device.
+func FlushCache(f *os.File) error {
+	if e := f.Sync(); e != nil {
+		return e
+	}
+	return ioctl(f, blkflsbuf, nil)
+}
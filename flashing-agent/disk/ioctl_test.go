@@ -0,0 +1,36 @@
+package disk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteZerosFile(t *testing.T) {
+	f, e := ioutil.TempFile("", "disk")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := bytes.Repeat([]byte{0xAA}, 3<<20)
+	if _, e := f.Write(data); e != nil {
+		t.Fatal(e)
+	}
+
+	// Regular files don't support BLKZEROOUT, so this writes zeros.
+	if e := (Device{f}).WriteZeros(512, 2<<20); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	for i := 512; i < 512+2<<20; i++ {
+		data[i] = 0
+	}
+	out, e := ioutil.ReadFile(f.Name())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("file contents differ from expected")
+	}
+}
@@ -3,12 +3,16 @@ package disk
 import (
 	"fmt"
 	"os"
+	"syscall"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
 
 	"github.com/tehwalris/ghw"
 )
 
 // OpenBySerial finds a a disk by serial and returns its block device file and metadata.
-func OpenBySerial(combinedSerial string) (file *os.File, diskInfo *ghw.Disk, err error) {
+// If readOnly is set, the file can't be written.
+func OpenBySerial(combinedSerial string, readOnly bool) (file *os.File, diskInfo *ghw.Disk, err error) {
 	blockInfo, e := ghw.Block()
 	if e != nil {
 		return nil, nil, e
@@ -20,9 +24,41 @@ func OpenBySerial(combinedSerial string) (file *os.File, diskInfo *ghw.Disk, err
 	if !found {
 		return nil, nil, fmt.Errorf("disk %v not found", combinedSerial)
 	}
-	f, e := os.OpenFile(fmt.Sprintf("/dev/%v", d.Name), os.O_RDWR|os.O_TRUNC, 0660)
+	return openDisk(d, readOnly)
+}
+
+// Open finds the disk which matches sel and returns its block device file and metadata.
+// If readOnly is set, the file can't be written.
+func Open(sel *pb.DiskSelector, readOnly bool) (file *os.File, diskInfo *ghw.Disk, err error) {
+	blockInfo, e := ghw.Block()
+	if e != nil {
+		return nil, nil, e
+	}
+	d, found, e := SelectDisk(blockInfo, sel, ReadAttrs)
+	if e != nil {
+		return nil, nil, e
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("no disk matches selector (%v)", SelectorString(sel))
+	}
+	return openDisk(d, readOnly)
+}
+
+func openDisk(d *ghw.Disk, readOnly bool) (*os.File, *ghw.Disk, error) {
+	flags := os.O_RDWR | os.O_TRUNC
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, e := os.OpenFile(fmt.Sprintf("/dev/%v", d.Name), flags, 0660)
 	if e != nil {
 		return nil, nil, e
 	}
 	return f, d, nil
 }
+
+// OpenDirect opens the same file as f again with O_DIRECT, so that writes bypass the page cache.
+// Writes to the returned file must be aligned to the logical sector size,
+// both in memory and on the disk.
+func OpenDirect(f *os.File) (*os.File, error) {
+	return os.OpenFile(f.Name(), os.O_RDWR|syscall.O_DIRECT, 0660)
+}
@@ -0,0 +1,188 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+
+	"github.com/tehwalris/ghw"
+)
+
+// Attrs are the properties of a disk which ghw does not provide.
+type Attrs struct {
+	Bus        pb.DiskBus
+	Rotational bool
+	Removable  bool
+	ByPath     []string // names of links in /dev/disk/by-path
+}
+
+// AttrsFunc returns the Attrs of a disk. ReadAttrs is used outside of tests.
+type AttrsFunc func(d *ghw.Disk) (Attrs, error)
+
+var sysBlockPath = "/sys/block"
+var byPathDir = "/dev/disk/by-path"
+
+// ReadAttrs reads the Attrs of a disk from sysfs and the udev links in /dev/disk/by-path.
+func ReadAttrs(d *ghw.Disk) (Attrs, error) {
+	var a Attrs
+	var e error
+	dir := path.Join(sysBlockPath, d.Name)
+	if a.Rotational, e = readFlag(path.Join(dir, "queue/rotational")); e != nil {
+		return a, e
+	}
+	if a.Removable, e = readFlag(path.Join(dir, "removable")); e != nil {
+		return a, e
+	}
+	// eg. ../devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda
+	dev, e := os.Readlink(dir)
+	if e != nil {
+		return a, e
+	}
+	a.Bus = busFromSysPath(d.Name, dev)
+
+	links, e := ioutil.ReadDir(byPathDir)
+	if e != nil && !os.IsNotExist(e) {
+		return a, e
+	}
+	for _, l := range links {
+		target, e := os.Readlink(path.Join(byPathDir, l.Name()))
+		if e == nil && filepath.Base(target) == d.Name {
+			a.ByPath = append(a.ByPath, l.Name())
+		}
+	}
+	return a, nil
+}
+
+func readFlag(p string) (bool, error) {
+	d, e := ioutil.ReadFile(p)
+	if e != nil {
+		return false, e
+	}
+	return strings.TrimSpace(string(d)) == "1", nil
+}
+
+func busFromSysPath(name string, dev string) pb.DiskBus {
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return pb.DiskBus_NVME
+	case strings.Contains(dev, "/usb"):
+		return pb.DiskBus_USB
+	case strings.Contains(dev, "/ata"):
+		return pb.DiskBus_SATA
+	case strings.Contains(dev, "/virtio"):
+		return pb.DiskBus_VIRTIO
+	}
+	return pb.DiskBus_ANY_BUS
+}
+
+// SelectDisk finds the only disk in blockInfo which matches sel.
+// It fails if more than one disk matches.
+func SelectDisk(
+	blockInfo *ghw.BlockInfo, sel *pb.DiskSelector, attrs AttrsFunc,
+) (disk *ghw.Disk, found bool, err error) {
+	if sel == nil || SelectorString(sel) == "" {
+		return nil, false, errors.New("empty disk selector")
+	}
+	if sel.Serial == "unknown" {
+		return nil, false, fmt.Errorf("bad serial number \"%v\" in disk selector", sel.Serial)
+	}
+	if sel.MaxSize != 0 && sel.MaxSize < sel.MinSize {
+		return nil, false, fmt.Errorf("disk selector has max_size %v below min_size %v", sel.MaxSize, sel.MinSize)
+	}
+	var matching []*ghw.Disk
+	for _, d := range blockInfo.Disks {
+		ok, e := matchesSelector(d, sel, attrs)
+		if e != nil {
+			return nil, false, fmt.Errorf("while reading properties of disk %v: %v", d.Name, e)
+		}
+		if ok {
+			matching = append(matching, d)
+		}
+	}
+	if len(matching) > 1 {
+		names := make([]string, len(matching))
+		for i, d := range matching {
+			names[i] = d.Name
+		}
+		return nil, false, fmt.Errorf(
+			"disk selector (%v) is ambiguous, matching %v disks (%v)",
+			SelectorString(sel), len(matching), strings.Join(names, ", "),
+		)
+	}
+	if len(matching) == 0 {
+		return nil, false, nil
+	}
+	return matching[0], true, nil
+}
+
+func matchesSelector(d *ghw.Disk, sel *pb.DiskSelector, attrs AttrsFunc) (bool, error) {
+	if sel.Serial != "" && d.SerialNumber != sel.Serial ||
+		sel.Wwn != "" && !strings.EqualFold(d.WWN, sel.Wwn) ||
+		sel.MinSize != 0 && d.SizeBytes < sel.MinSize ||
+		sel.MaxSize != 0 && d.SizeBytes > sel.MaxSize {
+		return false, nil
+	}
+	for _, m := range []struct{ pattern, value string }{{sel.Model, d.Model}, {sel.Vendor, d.Vendor}} {
+		if m.pattern == "" {
+			continue
+		}
+		ok, e := path.Match(m.pattern, m.value)
+		if e != nil {
+			return false, fmt.Errorf("bad pattern %q: %v", m.pattern, e)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if sel.Bus == pb.DiskBus_ANY_BUS && sel.Rotation == pb.DiskRotation_ANY_ROTATION &&
+		sel.ByPath == "" && !sel.NonRemovable {
+		return true, nil
+	}
+
+	a, e := attrs(d)
+	if e != nil {
+		return false, e
+	}
+	if sel.Bus != pb.DiskBus_ANY_BUS && a.Bus != sel.Bus ||
+		sel.Rotation == pb.DiskRotation_ROTATIONAL && !a.Rotational ||
+		sel.Rotation == pb.DiskRotation_NON_ROTATIONAL && a.Rotational ||
+		sel.NonRemovable && a.Removable {
+		return false, nil
+	}
+	if sel.ByPath != "" {
+		for _, p := range a.ByPath {
+			if p == sel.ByPath {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// SelectorString describes the set fields of a disk selector.
+func SelectorString(sel *pb.DiskSelector) string {
+	var parts []string
+	add := func(name string, v interface{}, set bool) {
+		if set {
+			parts = append(parts, fmt.Sprintf("%v: %v", name, v))
+		}
+	}
+	add("serial", sel.Serial, sel.Serial != "")
+	add("wwn", sel.Wwn, sel.Wwn != "")
+	add("model", sel.Model, sel.Model != "")
+	add("vendor", sel.Vendor, sel.Vendor != "")
+	add("min size", sel.MinSize, sel.MinSize != 0)
+	add("max size", sel.MaxSize, sel.MaxSize != 0)
+	add("bus", sel.Bus, sel.Bus != pb.DiskBus_ANY_BUS)
+	add("rotation", sel.Rotation, sel.Rotation != pb.DiskRotation_ANY_ROTATION)
+	add("by-path", sel.ByPath, sel.ByPath != "")
+	add("non-removable", sel.NonRemovable, sel.NonRemovable)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,107 @@
+package disk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tehwalris/ghw"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+func TestSelectDisk(t *testing.T) {
+	disks := []*ghw.Disk{
+		{Name: "sda", SerialNumber: "S1", WWN: "0x5000c500a1b2c3d4", Vendor: "ATA", Model: "ST4000NM0035", SizeBytes: 4000 << 30},
+		{Name: "sdb", SerialNumber: "S2", WWN: "0x5000c500a1b2c3d5", Vendor: "ATA", Model: "ST4000NM0035", SizeBytes: 4000 << 30},
+		{Name: "nvme0n1", SerialNumber: "S3", Vendor: "Samsung", Model: "SAMSUNG MZVLB512HAJQ", SizeBytes: 512 << 30},
+		{Name: "sdc", SerialNumber: "S4", Vendor: "SanDisk", Model: "Cruzer", SizeBytes: 16 << 30},
+	}
+	attrs := map[string]Attrs{
+		"sda":     {Bus: pb.DiskBus_SATA, Rotational: true, ByPath: []string{"pci-0000:00:17.0-ata-1"}},
+		"sdb":     {Bus: pb.DiskBus_SATA, Rotational: true, ByPath: []string{"pci-0000:00:17.0-ata-2"}},
+		"nvme0n1": {Bus: pb.DiskBus_NVME, ByPath: []string{"pci-0000:01:00.0-nvme-1"}},
+		"sdc":     {Bus: pb.DiskBus_USB, Removable: true, ByPath: []string{"pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0"}},
+	}
+	attrsFunc := func(d *ghw.Disk) (Attrs, error) {
+		return attrs[d.Name], nil
+	}
+	blockInfo := &ghw.BlockInfo{Disks: disks}
+
+	var cases = []struct {
+		label         string
+		sel           *pb.DiskSelector
+		expectedName  string // empty if no disk should be found
+		shouldContain string // expected error
+	}{
+		{"serial", &pb.DiskSelector{Serial: "S2"}, "sdb", ""},
+		{"wwn ignores case", &pb.DiskSelector{Wwn: "0x5000C500A1B2C3D4"}, "sda", ""},
+		{"model pattern", &pb.DiskSelector{Model: "SAMSUNG *"}, "nvme0n1", ""},
+		{"vendor", &pb.DiskSelector{Vendor: "SanDisk"}, "sdc", ""},
+		{"size range", &pb.DiskSelector{MinSize: 100 << 30, MaxSize: 1000 << 30}, "nvme0n1", ""},
+		{"bus", &pb.DiskSelector{Bus: pb.DiskBus_USB}, "sdc", ""},
+		{"non-rotational", &pb.DiskSelector{Rotation: pb.DiskRotation_NON_ROTATIONAL, NonRemovable: true}, "nvme0n1", ""},
+		{"by-path", &pb.DiskSelector{ByPath: "pci-0000:00:17.0-ata-2"}, "sdb", ""},
+		{"combined", &pb.DiskSelector{Model: "ST4000*", Rotation: pb.DiskRotation_ROTATIONAL, ByPath: "pci-0000:00:17.0-ata-1"}, "sda", ""},
+		{"no match", &pb.DiskSelector{Bus: pb.DiskBus_VIRTIO}, "", ""},
+		{"ambiguous", &pb.DiskSelector{Model: "ST4000NM0035"}, "", "ambiguous, matching 2 disks (sda, sdb)"},
+		{"ambiguous non-removable", &pb.DiskSelector{NonRemovable: true}, "", "matching 3 disks"},
+		{"empty", &pb.DiskSelector{}, "", "empty disk selector"},
+		{"nil", nil, "", "empty disk selector"},
+		{"unknown serial", &pb.DiskSelector{Serial: "unknown"}, "", "bad serial"},
+		{"bad size range", &pb.DiskSelector{MinSize: 2, MaxSize: 1}, "", "below min_size"},
+		{"bad pattern", &pb.DiskSelector{Model: "["}, "", "bad pattern"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			d, found, e := SelectDisk(blockInfo, c.sel, attrsFunc)
+			if c.shouldContain != "" {
+				if e == nil || !strings.Contains(e.Error(), c.shouldContain) {
+					t.Fatalf("got error %v, want error containing %q", e, c.shouldContain)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if found != (c.expectedName != "") {
+				t.Fatalf("got found %v, want %v", found, c.expectedName != "")
+			}
+			if found && d.Name != c.expectedName {
+				t.Errorf("got disk %v, want %v", d.Name, c.expectedName)
+			}
+		})
+	}
+}
+
+func TestSelectDiskReadsAttrsOnlyWhenNeeded(t *testing.T) {
+	blockInfo := &ghw.BlockInfo{Disks: []*ghw.Disk{{Name: "sda", SerialNumber: "S1"}}}
+	failing := func(d *ghw.Disk) (Attrs, error) {
+		return Attrs{}, errors.New("no sysfs")
+	}
+	if _, found, e := SelectDisk(blockInfo, &pb.DiskSelector{Serial: "S1"}, failing); e != nil || !found {
+		t.Errorf("got found %v and error %v, want disk found", found, e)
+	}
+	if _, _, e := SelectDisk(blockInfo, &pb.DiskSelector{NonRemovable: true}, failing); e == nil {
+		t.Errorf("got no error, want error from reading attributes")
+	}
+}
+
+func TestBusFromSysPath(t *testing.T) {
+	var cases = []struct {
+		name, dev string
+		expected  pb.DiskBus
+	}{
+		{"nvme0n1", "../devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n1", pb.DiskBus_NVME},
+		{"sda", "../devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda", pb.DiskBus_SATA},
+		{"sdb", "../devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb", pb.DiskBus_USB},
+		{"vda", "../devices/pci0000:00/0000:00:04.0/virtio1/block/vda", pb.DiskBus_VIRTIO},
+		{"sdc", "../devices/platform/host2/target2:0:0/2:0:0:0/block/sdc", pb.DiskBus_ANY_BUS},
+	}
+	for _, c := range cases {
+		if b := busFromSysPath(c.name, c.dev); b != c.expected {
+			t.Errorf("%v: got bus %v, want %v", c.name, b, c.expected)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 // The functions in this file read and write variables
@@ -18,6 +19,8 @@ var efivarsPerms os.FileMode = 0644
 // It is the EFI_GLOBAL_VARIABLE VendorGUID.
 var efiGlobalSuffix = "-8be4df61-93ca-11d2-aa0d-00e098032b8c"
 
+var bootEntryName = regexp.MustCompile("^Boot([0-9A-F]{4})" + efiGlobalSuffix + "$")
+
 // ReadBootOrder reads the EFI boot order variable.
 func ReadBootOrder() (*BootOrder, error) {
 	d, e := ioutil.ReadFile(path.Join(efivarsPath, "BootOrder"+efiGlobalSuffix))
@@ -36,14 +39,13 @@ func WriteBootOrder(ord BootOrder) error {
 // ReadBootEntries reads all existing EFI boot entries,
 // even if they are not in the boot order.
 func ReadBootEntries() (map[uint16]BootEntry, error) {
-	r := regexp.MustCompile("^Boot([0-9A-F]{4})" + efiGlobalSuffix + "$")
 	entries, e := ioutil.ReadDir(efivarsPath)
 	if e != nil {
 		return nil, e
 	}
 	out := make(map[uint16]BootEntry)
 	for _, v := range entries {
-		m := r.FindStringSubmatch(v.Name())
+		m := bootEntryName.FindStringSubmatch(v.Name())
 		if v.IsDir() || len(m) == 0 {
 			continue
 		}
@@ -80,6 +82,61 @@ func WriteBootEntries(entries map[uint16]BootEntry) error {
 	return nil
 }
 
+// ReadRawBootVars reads the BootOrder variable and every boot entry which
+// ReadBootEntries reads, keyed by variable name (eg. "Boot0001").
+// Values are the files from the efivars filesystem, including attributes.
+// BootOrder is left out if it does not exist.
+func ReadRawBootVars() (map[string][]byte, error) {
+	entries, e := ioutil.ReadDir(efivarsPath)
+	if e != nil {
+		return nil, e
+	}
+	out := make(map[string][]byte)
+	for _, v := range entries {
+		if v.IsDir() || (!bootEntryName.MatchString(v.Name()) && v.Name() != "BootOrder"+efiGlobalSuffix) {
+			continue
+		}
+		d, e := ioutil.ReadFile(path.Join(efivarsPath, v.Name()))
+		if e != nil {
+			return nil, e
+		}
+		out[strings.TrimSuffix(v.Name(), efiGlobalSuffix)] = d
+	}
+	return out, nil
+}
+
+// WriteRawBootVars restores variables read by ReadRawBootVars.
+// Boot entries which are not in vars are deleted.
+func WriteRawBootVars(vars map[string][]byte) error {
+	for k, d := range vars {
+		if !bootEntryName.MatchString(k+efiGlobalSuffix) && k != "BootOrder" {
+			return fmt.Errorf("not a boot variable: %q", k)
+		}
+		if len(d) < 4 {
+			return fmt.Errorf("variable %v too short: %v bytes", k, len(d))
+		}
+	}
+	for k, d := range vars {
+		if e := ioutil.WriteFile(path.Join(efivarsPath, k+efiGlobalSuffix), d, efivarsPerms); e != nil {
+			return e
+		}
+	}
+	entries, e := ioutil.ReadDir(efivarsPath)
+	if e != nil {
+		return e
+	}
+	for _, v := range entries {
+		name := strings.TrimSuffix(v.Name(), efiGlobalSuffix)
+		if _, ok := vars[name]; v.IsDir() || ok || !bootEntryName.MatchString(v.Name()) {
+			continue
+		}
+		if e := os.Remove(path.Join(efivarsPath, v.Name())); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 // IsEFIBooted checks that the machine is booted in EFI mode and
 // that the efivars filesystem is readable.
 func IsEFIBooted() bool {
@@ -0,0 +1,78 @@
+package efivars
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestRawBootVars(t *testing.T) {
+	dir, e := ioutil.TempDir("", "efivars")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { efivarsPath = p }(efivarsPath)
+	efivarsPath = dir
+
+	files := map[string][]byte{
+		"Boot0001" + efiGlobalSuffix:  {7, 0, 0, 0, 1},
+		"Boot000A" + efiGlobalSuffix:  {7, 0, 0, 0, 2},
+		"BootOrder" + efiGlobalSuffix: {7, 0, 0, 0, 1, 0, 10, 0},
+		"BootNext" + efiGlobalSuffix:  {7, 0, 0, 0, 1, 0},
+		"Boot0002-other-vendor":       {7, 0, 0, 0, 3},
+	}
+	for k, d := range files {
+		if e := ioutil.WriteFile(path.Join(dir, k), d, 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	vars, e := ReadRawBootVars()
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	expected := map[string][]byte{
+		"Boot0001":  {7, 0, 0, 0, 1},
+		"Boot000A":  {7, 0, 0, 0, 2},
+		"BootOrder": {7, 0, 0, 0, 1, 0, 10, 0},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected %v, got %v", expected, vars)
+	}
+
+	if e := WriteBootEntries(map[uint16]BootEntry{3: {
+		Description:     "new",
+		Path:            `\efi\boot.efi`,
+		PartitionGUID:   [16]byte{1},
+		PartitionNumber: 1,
+		PartitionStart:  2048,
+		PartitionSize:   2048,
+	}}); e != nil {
+		t.Fatal(e)
+	}
+	if e := WriteBootOrder(BootOrder{3}); e != nil {
+		t.Fatal(e)
+	}
+	if e := WriteRawBootVars(vars); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	restored, e := ReadRawBootVars()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %v after restoring, got %v", expected, restored)
+	}
+	for _, k := range []string{"BootNext" + efiGlobalSuffix, "Boot0002-other-vendor"} {
+		if _, e := os.Stat(path.Join(dir, k)); e != nil {
+			t.Errorf("other variable %v was removed: %v", k, e)
+		}
+	}
+
+	if e := WriteRawBootVars(map[string][]byte{"PK": {7, 0, 0, 0}}); e == nil {
+		t.Errorf("expected error for non-boot variable")
+	}
+}
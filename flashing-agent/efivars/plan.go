@@ -9,6 +9,7 @@ import (
 )
 
 var softmetalEntryDesc = "Softmetal (boot from disk)"
+var softmetalEntryPrefix = "Softmetal (boot from disk"
 var espGUIDStr = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
 
 // Update specifies a set of modifications to EFI boot variables.
@@ -25,45 +26,82 @@ type Update struct {
 // PlanUpdate recognizes the softmetal boot entry by description only.
 // If there are multiple softmetal boot entries, PlanUpdate will fail.
 func PlanUpdate(oldOrd BootOrder, oldEntries map[uint16]BootEntry, newEntry BootEntry) (*Update, error) {
-	if newEntry.Description != "" {
-		return nil, fmt.Errorf("newEntry.Description must be empty, got %v", newEntry.Description)
-	}
-	newEntry.Description = softmetalEntryDesc
+	return PlanUpdates(oldOrd, oldEntries, []BootEntry{newEntry})
+}
 
+// PlanUpdates is like PlanUpdate, but plans one boot entry for each disk of a mirror.
+// The entries load in the order of newEntries, so that the firmware falls back
+// to the next disk if one fails. Each entry has its own description, by which
+// it is recognized. Softmetal boot entries for disks which are not in
+// newEntries anymore are removed from the boot order.
+func PlanUpdates(oldOrd BootOrder, oldEntries map[uint16]BootEntry, newEntries []BootEntry) (*Update, error) {
+	if len(newEntries) == 0 {
+		return nil, fmt.Errorf("no boot entries to plan")
+	}
 	var usedByID = make(map[uint16]struct{})
 	for k := range oldEntries {
 		usedByID[k] = struct{}{}
 	}
 
-	var foundID bool
-	var newID uint16
-	for k, v := range oldEntries {
-		if v.Description == softmetalEntryDesc {
-			if foundID {
-				return nil, fmt.Errorf("found muliple existing softmetal boot entries")
+	up := &Update{Write: make(map[uint16]BootEntry)}
+	for i, newEntry := range newEntries {
+		if newEntry.Description != "" {
+			return nil, fmt.Errorf("newEntry.Description must be empty, got %v", newEntry.Description)
+		}
+		// The firmware finds the partition by its GUID, so it could not
+		// fall back to another disk.
+		for _, o := range newEntries[:i] {
+			if o.PartitionGUID == newEntry.PartitionGUID {
+				return nil, fmt.Errorf("boot entries for disks must use distinct partitions, got %v twice",
+					newEntry.PartitionGUID.String())
 			}
-			foundID = true
-			newID = k
 		}
-	}
-	for i := 0; !foundID && i <= math.MaxUint16; i++ {
-		if _, prs := usedByID[uint16(i)]; !prs {
-			foundID = true
-			newID = uint16(i)
+		newEntry.Description = entryDesc(i)
+
+		var foundID bool
+		var newID uint16
+		for k, v := range oldEntries {
+			if v.Description == newEntry.Description {
+				if foundID {
+					return nil, fmt.Errorf("found muliple existing softmetal boot entries")
+				}
+				foundID = true
+				newID = k
+			}
 		}
-	}
-	if !foundID {
-		return nil, fmt.Errorf("no free boot entry IDs (%v boot entries exist)", len(oldEntries))
+		for i := 0; !foundID && i <= math.MaxUint16; i++ {
+			if _, prs := usedByID[uint16(i)]; !prs {
+				foundID = true
+				newID = uint16(i)
+			}
+		}
+		if !foundID {
+			return nil, fmt.Errorf("no free boot entry IDs (%v boot entries exist)", len(usedByID))
+		}
+		usedByID[newID] = struct{}{}
+		up.Write[newID] = newEntry
+		up.Order = append(up.Order, newID)
 	}
 
-	newOrd := BootOrder{newID}
 	for _, v := range oldOrd {
-		if v != newID {
-			newOrd = append(newOrd, v)
+		if _, prs := up.Write[v]; prs {
+			continue
+		}
+		if e, prs := oldEntries[v]; prs && strings.HasPrefix(e.Description, softmetalEntryPrefix) {
+			continue
 		}
+		up.Order = append(up.Order, v)
 	}
+	return up, nil
+}
 
-	return &Update{Write: map[uint16]BootEntry{newID: newEntry}, Order: newOrd}, nil
+// entryDesc returns the description of the boot entry for the i-th disk.
+// The first disk uses the description from before mirrors were supported.
+func entryDesc(i int) string {
+	if i == 0 {
+		return softmetalEntryDesc
+	}
+	return fmt.Sprintf("%v %v)", softmetalEntryPrefix, i+1)
 }
 
 // NewBootEntry creates a boot entry for softmetal by finding required
@@ -78,7 +116,7 @@ func NewBootEntry(path string, partitions []gpt.Partition) (*BootEntry, error) {
 	var targetIdx int
 	var found int
 	for i, p := range partitions {
-		if strings.ToLower(p.Type.String()) == strings.ToLower(espGUIDStr) {
+		if IsESP(&p) {
 			targetIdx = i
 			found++
 		}
@@ -95,3 +133,8 @@ func NewBootEntry(path string, partitions []gpt.Partition) (*BootEntry, error) {
 		PartitionSize:   p.LastLBA - p.FirstLBA + 1,
 	}, nil
 }
+
+// IsESP returns whether p has the type of an EFI System partition.
+func IsESP(p *gpt.Partition) bool {
+	return strings.ToLower(p.Type.String()) == strings.ToLower(espGUIDStr)
+}
@@ -160,6 +160,84 @@ func TestPlanUpdate(t *testing.T) {
 	}
 }
 
+func TestPlanUpdates(t *testing.T) {
+	first := efivars.BootEntry{Path: `\efi\boot.efi`, PartitionGUID: testUuids[1]}
+	second := efivars.BootEntry{Path: `\efi\boot.efi`, PartitionGUID: testUuids[2]}
+	firstExp := first
+	firstExp.Description = "Softmetal (boot from disk)"
+	secondExp := second
+	secondExp.Description = "Softmetal (boot from disk 2)"
+
+	oldOrd := efivars.BootOrder{0x03, 0x01, 0x04}
+	oldEntries := map[uint16]efivars.BootEntry{
+		0x00: {Description: "test entry 0x00"},
+		0x01: {Description: "Softmetal (boot from disk)"},
+		0x03: {Description: "test entry 0x03"},
+		0x04: {Description: "Softmetal (boot from disk 3)"},
+	}
+	act, e := efivars.PlanUpdates(oldOrd, oldEntries, []efivars.BootEntry{first, second})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	exp := &efivars.Update{
+		Write: map[uint16]efivars.BootEntry{0x01: firstExp, 0x02: secondExp},
+		Order: efivars.BootOrder{0x01, 0x02, 0x03},
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("got %+v, want %+v", act, exp)
+	}
+
+	// Going back to a single disk removes the second entry from the order.
+	oldEntries[0x02] = secondExp
+	act, e = efivars.PlanUpdate(exp.Order, oldEntries, first)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	exp = &efivars.Update{
+		Write: map[uint16]efivars.BootEntry{0x01: firstExp},
+		Order: efivars.BootOrder{0x01, 0x03},
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("got %+v, want %+v", act, exp)
+	}
+}
+
+func TestPlanUpdatesMirrorESPs(t *testing.T) {
+	espType := gpt.PartType{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}
+	disk := func(espID gpt.Guid) efivars.BootEntry {
+		ent, e := efivars.NewBootEntry(`\efi\boot.efi`, []gpt.Partition{
+			{Type: gpt.PartType(testUuids[3]), Id: testUuids[4], FirstLBA: 2048, LastLBA: 4095},
+			{Type: espType, Id: espID, FirstLBA: 4096, LastLBA: 8191},
+		})
+		if e != nil {
+			t.Fatalf("unexpected error: %v", e)
+		}
+		return *ent
+	}
+
+	oldEntries := map[uint16]efivars.BootEntry{0x00: {Description: "test entry 0x00"}}
+	act, e := efivars.PlanUpdates(efivars.BootOrder{0x00}, oldEntries,
+		[]efivars.BootEntry{disk(testUuids[1]), disk(testUuids[2])})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !reflect.DeepEqual(act.Order, efivars.BootOrder{0x01, 0x02, 0x00}) {
+		t.Errorf("got boot order %v, want [1 2 0]", act.Order)
+	}
+	for id, guid := range map[uint16]gpt.Guid{0x01: testUuids[1], 0x02: testUuids[2]} {
+		if w := act.Write[id]; w.PartitionGUID != guid || w.PartitionNumber != 2 {
+			t.Errorf("entry %04X: got partition %v (number %v), want %v (number 2)",
+				id, w.PartitionGUID.String(), w.PartitionNumber, guid.String())
+		}
+	}
+
+	// Both entries would load from whichever disk the firmware finds first.
+	if _, e := efivars.PlanUpdates(efivars.BootOrder{0x00}, oldEntries,
+		[]efivars.BootEntry{disk(testUuids[1]), disk(testUuids[1])}); e == nil {
+		t.Errorf("got no error for disks with the same ESP GUID, want some error")
+	}
+}
+
 func TestNewBootEntry(t *testing.T) {
 	espType := gpt.PartType{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}
 	bootEntry := func(idIdx int, num uint32, start uint64, size uint64) *efivars.BootEntry {
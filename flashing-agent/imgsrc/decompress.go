@@ -0,0 +1,91 @@
+package imgsrc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var gzipMagic = []byte{0x1F, 0x8B}
+var xzMagic = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// maxMagicLen is the number of bytes DetectCompression needs to recognize every format.
+const maxMagicLen = 6
+
+// DetectCompression guesses the compression format of an image from its first bytes.
+// If no known magic number matches, it returns Compression_NO_COMPRESSION.
+func DetectCompression(header []byte) pb.Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return pb.Compression_GZIP
+	case bytes.HasPrefix(header, xzMagic):
+		return pb.Compression_XZ
+	case bytes.HasPrefix(header, zstdMagic):
+		return pb.Compression_ZSTD
+	}
+	return pb.Compression_NO_COMPRESSION
+}
+
+// Decompress wraps a (possibly) compressed image so that reads return the uncompressed image.
+// With Compression_AUTO_DETECT, the format is chosen by DetectCompression.
+// Closing the returned reader also closes src.
+func Decompress(src io.ReadCloser, c pb.Compression) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+	if c == pb.Compression_AUTO_DETECT {
+		header, e := br.Peek(maxMagicLen)
+		if e != nil && e != io.EOF {
+			return nil, fmt.Errorf("while detecting compression: %v", e)
+		}
+		c = DetectCompression(header)
+	}
+
+	switch c {
+	case pb.Compression_NO_COMPRESSION:
+		return &decompressor{Reader: br, src: src}, nil
+	case pb.Compression_GZIP:
+		r, e := gzip.NewReader(br)
+		if e != nil {
+			return nil, fmt.Errorf("while opening gzip stream: %v", e)
+		}
+		return &decompressor{Reader: r, src: src, close: r.Close}, nil
+	case pb.Compression_XZ:
+		r, e := xz.NewReader(br)
+		if e != nil {
+			return nil, fmt.Errorf("while opening xz stream: %v", e)
+		}
+		return &decompressor{Reader: r, src: src}, nil
+	case pb.Compression_ZSTD:
+		r, e := zstd.NewReader(br)
+		if e != nil {
+			return nil, fmt.Errorf("while opening zstd stream: %v", e)
+		}
+		return &decompressor{Reader: r, src: src, close: func() error {
+			r.Close()
+			return nil
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %v", c)
+}
+
+type decompressor struct {
+	io.Reader
+	src   io.Closer
+	close func() error // closes Reader, may be nil
+}
+
+func (d *decompressor) Close() error {
+	if d.close != nil {
+		if e := d.close(); e != nil {
+			d.src.Close()
+			return e
+		}
+	}
+	return d.src.Close()
+}
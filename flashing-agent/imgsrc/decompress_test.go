@@ -0,0 +1,123 @@
+package imgsrc_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/imgsrc"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func compress(t *testing.T, c pb.Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var e error
+	switch c {
+	case pb.Compression_NO_COMPRESSION:
+		return data
+	case pb.Compression_GZIP:
+		w = gzip.NewWriter(&buf)
+	case pb.Compression_XZ:
+		w, e = xz.NewWriter(&buf)
+	case pb.Compression_ZSTD:
+		w, e = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("can't compress with %v", c)
+	}
+	if e != nil {
+		t.Fatalf("while creating writer: %v", e)
+	}
+	if _, e := w.Write(data); e != nil {
+		t.Fatalf("while compressing: %v", e)
+	}
+	if e := w.Close(); e != nil {
+		t.Fatalf("while closing writer: %v", e)
+	}
+	return buf.Bytes()
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestDecompress(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * i / 7)
+	}
+	cases := []struct {
+		label      string
+		actual     pb.Compression
+		declared   pb.Compression
+		shouldFail bool
+	}{
+		{"raw (declared)", pb.Compression_NO_COMPRESSION, pb.Compression_NO_COMPRESSION, false},
+		{"gzip (declared)", pb.Compression_GZIP, pb.Compression_GZIP, false},
+		{"xz (declared)", pb.Compression_XZ, pb.Compression_XZ, false},
+		{"zstd (declared)", pb.Compression_ZSTD, pb.Compression_ZSTD, false},
+		{"raw (detected)", pb.Compression_NO_COMPRESSION, pb.Compression_AUTO_DETECT, false},
+		{"gzip (detected)", pb.Compression_GZIP, pb.Compression_AUTO_DETECT, false},
+		{"xz (detected)", pb.Compression_XZ, pb.Compression_AUTO_DETECT, false},
+		{"zstd (detected)", pb.Compression_ZSTD, pb.Compression_AUTO_DETECT, false},
+		{"raw declared as gzip", pb.Compression_NO_COMPRESSION, pb.Compression_GZIP, true},
+		{"xz declared as zstd", pb.Compression_XZ, pb.Compression_ZSTD, true},
+		{"unknown compression", pb.Compression_NO_COMPRESSION, pb.Compression(99), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			src := &closeRecorder{Reader: bytes.NewReader(compress(t, c.actual, data))}
+			r, e := imgsrc.Decompress(src, c.declared)
+			var act []byte
+			if e == nil {
+				act, e = ioutil.ReadAll(r)
+			}
+			if c.shouldFail {
+				if e == nil {
+					t.Errorf("got no error, want some error")
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(act, data) {
+				t.Errorf("got %v bytes of different data, want original %v bytes", len(act), len(data))
+			}
+			if e := r.Close(); e != nil {
+				t.Errorf("unexpected error while closing: %v", e)
+			}
+			if !src.closed {
+				t.Errorf("source not closed")
+			}
+		})
+	}
+}
+
+func TestDecompressShortInput(t *testing.T) {
+	for _, data := range [][]byte{{}, {0x1F}, {0x28, 0xB5, 0x2F}} {
+		r, e := imgsrc.Decompress(ioutil.NopCloser(bytes.NewReader(data)), pb.Compression_AUTO_DETECT)
+		if e != nil {
+			t.Errorf("unexpected error for %v byte input: %v", len(data), e)
+			continue
+		}
+		act, e := ioutil.ReadAll(r)
+		if e != nil {
+			t.Errorf("unexpected error while reading %v byte input: %v", len(data), e)
+		}
+		if !bytes.Equal(act, data) {
+			t.Errorf("got %v, want %v", act, data)
+		}
+	}
+}
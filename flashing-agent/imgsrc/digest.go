@@ -0,0 +1,54 @@
+package imgsrc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// DigestReader hashes all data which is read through it.
+type DigestReader struct {
+	r io.Reader
+	h hash.Hash
+	n uint64
+}
+
+// NewSHA256Reader returns a DigestReader which computes the SHA-256 of r.
+func NewSHA256Reader(r io.Reader) *DigestReader {
+	return &DigestReader{r: r, h: sha256.New()}
+}
+
+func (d *DigestReader) Read(p []byte) (int, error) {
+	n, e := d.r.Read(p)
+	d.h.Write(p[:n])
+	d.n += uint64(n)
+	return n, e
+}
+
+// ParseSHA256 decodes a hex encoded SHA-256 digest.
+func ParseSHA256(s string) ([]byte, error) {
+	d, e := hex.DecodeString(s)
+	if e != nil {
+		return nil, fmt.Errorf("invalid SHA-256 %q: %v", s, e)
+	}
+	if len(d) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 %q: got %v bytes, want %v", s, len(d), sha256.Size)
+	}
+	return d, nil
+}
+
+// Verify reads the remaining data from the underlying reader and
+// checks that the digest of everything read matches exp.
+func (d *DigestReader) Verify(exp []byte) error {
+	if _, e := io.Copy(ioutil.Discard, d); e != nil {
+		return fmt.Errorf("while reading rest of image: %v", e)
+	}
+	if act := d.h.Sum(nil); !bytes.Equal(act, exp) {
+		return fmt.Errorf("image digest mismatch after %v bytes: got %x, want %x", d.n, act, exp)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package imgsrc_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/imgsrc"
+)
+
+func TestParseSHA256(t *testing.T) {
+	sum := sha256.Sum256([]byte("walrus"))
+	cases := []struct {
+		label      string
+		input      string
+		shouldFail bool
+	}{
+		{"valid (lower case)", hex.EncodeToString(sum[:]), false},
+		{"valid (upper case)", strings.ToUpper(hex.EncodeToString(sum[:])), false},
+		{"empty", "", true},
+		{"too short", hex.EncodeToString(sum[:31]), true},
+		{"not hex", strings.Repeat("zz", 32), true},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			act, e := imgsrc.ParseSHA256(c.input)
+			if c.shouldFail {
+				if e == nil {
+					t.Errorf("got no error, want some error")
+				}
+				return
+			}
+			if e != nil {
+				t.Errorf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(act, sum[:]) {
+				t.Errorf("got %x, want %x", act, sum)
+			}
+		})
+	}
+}
+
+func TestDigestReaderVerify(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	sum := sha256.Sum256(data)
+	cases := []struct {
+		label      string
+		data       []byte
+		consume    int64 // bytes read before Verify
+		shouldFail bool
+	}{
+		{"nothing read before verify", data, 0, false},
+		{"partially read before verify", data, 10, false},
+		{"fully read before verify", data, int64(len(data)), false},
+		{"truncated", data[:len(data)-1], 10, true},
+		{"corrupted", append([]byte{'X'}, data[1:]...), 10, true},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			r := imgsrc.NewSHA256Reader(bytes.NewReader(c.data))
+			if _, e := io.CopyN(&bytes.Buffer{}, r, c.consume); e != nil {
+				t.Fatalf("unexpected error while reading: %v", e)
+			}
+			e := r.Verify(sum[:])
+			if c.shouldFail && e == nil {
+				t.Errorf("got no error, want some error")
+			}
+			if !c.shouldFail && e != nil {
+				t.Errorf("unexpected error: %v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package imgsrc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpClient sends the requests of HTTPReader and HTTPSource.
+type httpClient struct {
+	c    *http.Client        // http.DefaultClient if nil
+	sign func(*http.Request) // authenticates requests (eg. for S3), may be nil
+}
+
+func (h httpClient) do(method string, url string, header http.Header) (*http.Response, error) {
+	req, e := http.NewRequest(method, url, nil)
+	if e != nil {
+		return nil, e
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if h.sign != nil {
+		h.sign(req)
+	}
+	c := h.c
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return c.Do(req)
+}
+
+// retryDelay is the time HTTPReader and HTTPSource wait before the first retry.
+// The delay doubles with each consecutive failure, up to maxRetryDelay.
+var retryDelay = time.Second
+var maxRetryDelay = 30 * time.Second
+
+// backoff returns the delay before a retry after the given number of
+// consecutive failures (at least 1).
+func backoff(failures int) time.Duration {
+	d := retryDelay
+	for i := 1; i < failures && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// RetryFunc is called before HTTPReader reconnects after an error.
+// The offset is the position in the downloaded stream where reading will continue.
+type RetryFunc func(offset uint64, retry int, e error)
+
+// HTTPReader downloads a file over HTTP. When the download fails,
+// it reconnects and continues with a Range request at the first byte which
+// was not read yet. It reconnects at most maxRetries times in total.
+type HTTPReader struct {
+	url        string
+	client     httpClient
+	maxRetries int
+	retries    int
+	failures   int // consecutive failed connections, for backoff
+	onRetry    RetryFunc
+
+	body      io.ReadCloser
+	offset    uint64
+	size      int64  // -1 if unknown
+	validator string // ETag or Last-Modified of the first response
+}
+
+// OpenHTTP starts downloading a file over HTTP.
+// The onRetry callback may be nil.
+func OpenHTTP(url string, maxRetries int, onRetry RetryFunc) (*HTTPReader, error) {
+	return openHTTP(httpClient{}, url, maxRetries, onRetry)
+}
+
+func openHTTP(client httpClient, url string, maxRetries int, onRetry RetryFunc) (*HTTPReader, error) {
+	r := &HTTPReader{
+		url:        url,
+		client:     client,
+		maxRetries: maxRetries,
+		onRetry:    onRetry,
+	}
+	res, e := r.client.do(http.MethodGet, url, nil)
+	if e != nil {
+		return nil, e
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status: %v", res.Status)
+	}
+	r.body = res.Body
+	r.size = res.ContentLength
+	r.validator = responseValidator(res)
+	return r, nil
+}
+
+// responseValidator returns a value for If-Range which matches the response.
+func responseValidator(res *http.Response) string {
+	v := res.Header.Get("ETag")
+	if v == "" || strings.HasPrefix(v, "W/") {
+		// Weak ETags can't be used with If-Range.
+		v = res.Header.Get("Last-Modified")
+	}
+	return v
+}
+
+func (r *HTTPReader) Read(p []byte) (int, error) {
+	for {
+		n, e := r.body.Read(p)
+		r.offset += uint64(n)
+		if e == io.EOF && r.size >= 0 && r.offset < uint64(r.size) {
+			e = io.ErrUnexpectedEOF
+		}
+		if e == nil || e == io.EOF {
+			if n > 0 {
+				r.failures = 0
+			}
+			return n, e
+		}
+		if re := r.reconnect(e); re != nil {
+			return n, re
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the current connection.
+func (r *HTTPReader) Close() error {
+	return r.body.Close()
+}
+
+func (r *HTTPReader) reconnect(cause error) error {
+	r.body.Close()
+	for {
+		if r.retries >= r.maxRetries {
+			return fmt.Errorf("giving up after %v retries: %v", r.retries, cause)
+		}
+		r.retries++
+		r.failures++
+		if r.onRetry != nil {
+			r.onRetry(r.offset, r.retries, cause)
+		}
+		time.Sleep(backoff(r.failures))
+		body, canRetry, e := r.requestRest()
+		if e == nil {
+			r.body = body
+			return nil
+		}
+		if !canRetry {
+			return e
+		}
+		cause = e
+	}
+}
+
+// requestRest requests everything after the current offset.
+// If it fails, canRetry reports whether trying again could help.
+func (r *HTTPReader) requestRest() (body io.ReadCloser, canRetry bool, err error) {
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%v-", r.offset))
+	if r.validator != "" {
+		// Makes the server send the whole file (status 200) if it changed.
+		h.Set("If-Range", r.validator)
+	}
+	res, e := r.client.do(http.MethodGet, r.url, h)
+	if e != nil {
+		return nil, true, e
+	}
+	if res.StatusCode >= 500 {
+		res.Body.Close()
+		return nil, true, fmt.Errorf("unexpected HTTP status: %v", res.Status)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, false, fmt.Errorf(
+			"got HTTP status %v for range request (server does not support ranges or file changed)",
+			res.Status)
+	}
+	if start, e := contentRangeStart(res.Header.Get("Content-Range")); e != nil || start != r.offset {
+		res.Body.Close()
+		return nil, false, fmt.Errorf("unexpected Content-Range %q for request at offset %v",
+			res.Header.Get("Content-Range"), r.offset)
+	}
+	return res.Body, true, nil
+}
+
+// contentRangeStart parses the first byte position from a
+// Content-Range header value, eg. "bytes 100-199/200".
+func contentRangeStart(v string) (uint64, error) {
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, fmt.Errorf("unsupported Content-Range: %q", v)
+	}
+	v = strings.TrimPrefix(v, "bytes ")
+	i := strings.IndexByte(v, '-')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range: %q", v)
+	}
+	return strconv.ParseUint(v[:i], 10, 64)
+}
+
+// HTTPSource is an image which is downloaded over HTTP.
+// Random access uses Range requests, so the server has to support them.
+type HTTPSource struct {
+	URL string
+	Options
+
+	client    httpClient
+	mu        sync.Mutex
+	retries   int    // retries used by ReadAt
+	validator string // ETag or Last-Modified of the first ReadAt response
+}
+
+func (s *HTTPSource) Open() (io.ReadCloser, error) {
+	return openHTTP(s.client, s.URL, s.MaxRetries, s.OnRetry)
+}
+
+// Size returns the Content-Length of a HEAD request, or -1 if the server does not send it.
+func (s *HTTPSource) Size() (int64, error) {
+	res, e := s.client.do(http.MethodHead, s.URL, nil)
+	if e != nil {
+		return 0, e
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status: %v", res.Status)
+	}
+	return res.ContentLength, nil
+}
+
+// ReadAt reads len(p) bytes with a single Range request. Failed requests are
+// retried, with at most MaxRetries retries over all calls.
+func (s *HTTPSource) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for failures := 1; ; failures++ {
+		n, canRetry, e := s.readRange(p, off)
+		if e == nil || !canRetry {
+			return n, e
+		}
+		s.mu.Lock()
+		if s.retries >= s.MaxRetries {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("giving up after %v retries: %v", s.MaxRetries, e)
+		}
+		s.retries++
+		retry := s.retries
+		s.mu.Unlock()
+		if s.OnRetry != nil {
+			s.OnRetry(uint64(off), retry, e)
+		}
+		time.Sleep(backoff(failures))
+	}
+}
+
+// Close does nothing, since every ReadAt uses its own request.
+func (s *HTTPSource) Close() error {
+	return nil
+}
+
+func (s *HTTPSource) readRange(p []byte, off int64) (n int, canRetry bool, err error) {
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%v-%v", off, off+int64(len(p))-1))
+	s.mu.Lock()
+	validator := s.validator
+	s.mu.Unlock()
+	if validator != "" {
+		h.Set("If-Range", validator)
+	}
+	res, e := s.client.do(http.MethodGet, s.URL, h)
+	if e != nil {
+		return 0, true, e
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, false, io.EOF
+	}
+	if res.StatusCode >= 500 {
+		return 0, true, fmt.Errorf("unexpected HTTP status: %v", res.Status)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return 0, false, fmt.Errorf(
+			"got HTTP status %v for range request (server does not support ranges or file changed)",
+			res.Status)
+	}
+	if start, e := contentRangeStart(res.Header.Get("Content-Range")); e != nil || start != uint64(off) {
+		return 0, false, fmt.Errorf("unexpected Content-Range %q for request at offset %v",
+			res.Header.Get("Content-Range"), off)
+	}
+	if validator == "" {
+		s.mu.Lock()
+		s.validator = responseValidator(res)
+		s.mu.Unlock()
+	}
+
+	n, e = io.ReadFull(res.Body, p)
+	if e == io.ErrUnexpectedEOF && res.ContentLength >= 0 && int64(n) == res.ContentLength {
+		// The range was cut off at the end of the file.
+		return n, false, io.EOF
+	}
+	if e != nil {
+		return n, true, e
+	}
+	return n, false, nil
+}
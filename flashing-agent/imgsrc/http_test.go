@@ -0,0 +1,205 @@
+package imgsrc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves data, but cuts off the first len(cutAt) responses
+// after the given number of bytes.
+type flakyServer struct {
+	data        []byte
+	etag        string
+	noRanges    bool
+	changeOnCut bool
+	mu          sync.Mutex
+	cutAt       []int
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var cut = -1
+	if len(s.cutAt) > 0 {
+		cut = s.cutAt[0]
+		s.cutAt = s.cutAt[1:]
+	}
+	etag := s.etag
+	if cut != -1 && s.changeOnCut {
+		s.etag = s.etag + "x"
+	}
+	s.mu.Unlock()
+
+	if s.noRanges {
+		r.Header.Del("Range")
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if cut == -1 {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.data))
+		return
+	}
+	// Declare the full length, but only send part of the data,
+	// which makes the client see an unexpected EOF.
+	rec := httptest.NewRecorder()
+	if etag != "" {
+		rec.Header().Set("ETag", etag)
+	}
+	http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(s.data))
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(rec.Body.Len()))
+	w.WriteHeader(rec.Code)
+	body := rec.Body.Bytes()
+	if cut < len(body) {
+		body = body[:cut]
+	}
+	w.Write(body)
+}
+
+func TestHTTPReader(t *testing.T) {
+	retryDelay = time.Millisecond
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 13 / 11)
+	}
+	cases := []struct {
+		label      string
+		server     *flakyServer
+		maxRetries int
+		expRetries []uint64 // offsets passed to onRetry
+		shouldFail bool
+	}{
+		{"no errors",
+			&flakyServer{}, 0, nil, false},
+		{"single error",
+			&flakyServer{cutAt: []int{1234}}, 1, []uint64{1234}, false},
+		{"multiple errors",
+			&flakyServer{cutAt: []int{1000, 2000, 0}}, 5, []uint64{1000, 3000, 3000}, false},
+		{"multiple errors (with ETag)",
+			&flakyServer{cutAt: []int{1000, 2000}, etag: `"walrus"`}, 2, []uint64{1000, 3000}, false},
+		{"too many errors",
+			&flakyServer{cutAt: []int{1000, 2000, 3000}}, 2, []uint64{1000, 3000}, true},
+		{"no range support",
+			&flakyServer{cutAt: []int{1000}, noRanges: true}, 5, []uint64{1000}, true},
+		{"file changed",
+			&flakyServer{cutAt: []int{1000}, etag: `"walrus"`, changeOnCut: true}, 5, []uint64{1000}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			c.server.data = data
+			srv := httptest.NewServer(c.server)
+			defer srv.Close()
+
+			var retries []uint64
+			onRetry := func(offset uint64, retry int, e error) {
+				retries = append(retries, offset)
+				if retry != len(retries) {
+					t.Errorf("got retry number %v, want %v", retry, len(retries))
+				}
+			}
+			r, e := OpenHTTP(srv.URL, c.maxRetries, onRetry)
+			if e != nil {
+				t.Fatalf("unexpected error while opening: %v", e)
+			}
+			act, e := ioutil.ReadAll(r)
+			r.Close()
+
+			if c.shouldFail {
+				if e == nil {
+					t.Errorf("got no error, want some error")
+				}
+			} else {
+				if e != nil {
+					t.Errorf("unexpected error: %v", e)
+				}
+				if !bytes.Equal(act, data) {
+					t.Errorf("got %v bytes of different data, want original %v bytes", len(act), len(data))
+				}
+			}
+			if len(retries) != len(c.expRetries) {
+				t.Fatalf("got retries at %v, want %v", retries, c.expRetries)
+			}
+			for i := range retries {
+				if retries[i] != c.expRetries[i] {
+					t.Errorf("got retries at %v, want %v", retries, c.expRetries)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer func(d, m time.Duration) { retryDelay, maxRetryDelay = d, m }(retryDelay, maxRetryDelay)
+	retryDelay = time.Second
+	maxRetryDelay = 10 * time.Second
+	exp := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range exp {
+		if got := backoff(i + 1); got != d {
+			t.Errorf("failure %v: got delay %v, want %v", i+1, got, d)
+		}
+	}
+	if got := backoff(1000); got != maxRetryDelay {
+		t.Errorf("got delay %v after many failures, want %v", got, maxRetryDelay)
+	}
+}
+
+func TestOpenHTTPStatus(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, e := OpenHTTP(srv.URL, 5, nil); e == nil {
+		t.Errorf("got no error, want some error")
+	}
+}
+
+func TestHTTPSourceReadAt(t *testing.T) {
+	retryDelay = time.Millisecond
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i * 13 / 11)
+	}
+	srv := httptest.NewServer(&flakyServer{data: data, etag: `"walrus"`, cutAt: []int{10}})
+	defer srv.Close()
+
+	var retries []uint64
+	s := &HTTPSource{URL: srv.URL, Options: Options{
+		MaxRetries: 1,
+		OnRetry:    func(offset uint64, retry int, e error) { retries = append(retries, offset) },
+	}}
+	cases := []struct {
+		off    int64
+		n      int
+		expN   int
+		expEOF bool
+	}{
+		{100, 200, 200, false}, // cut off once, then retried
+		{0, 1, 1, false},
+		{4990, 20, 10, true},
+		{5000, 20, 0, true},
+	}
+	for _, c := range cases {
+		p := make([]byte, c.n)
+		n, e := s.ReadAt(p, c.off)
+		if n != c.expN || (e == io.EOF) != c.expEOF || (e != nil && e != io.EOF) {
+			t.Errorf("ReadAt(%v bytes at %v): got (%v, %v), want %v bytes (EOF: %v)",
+				c.n, c.off, n, e, c.expN, c.expEOF)
+			continue
+		}
+		if !bytes.Equal(p[:n], data[c.off:c.off+int64(n)]) {
+			t.Errorf("ReadAt(%v bytes at %v): got different data", c.n, c.off)
+		}
+	}
+	if len(retries) != 1 || retries[0] != 100 {
+		t.Errorf("got retries at %v, want [100]", retries)
+	}
+}
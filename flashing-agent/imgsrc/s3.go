@@ -0,0 +1,148 @@
+package imgsrc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures access to an S3 compatible object store.
+// Objects are addressed as s3://bucket/key and requested path-style
+// (<Endpoint>/<bucket>/<key>), which all common implementations support.
+type S3Config struct {
+	Endpoint        string // eg. "https://minio.example.com:9000", AWS if empty
+	Region          string // "us-east-1" if empty
+	AccessKeyID     string // requests are not signed if empty
+	SecretAccessKey string
+}
+
+// emptySHA256 is the hex encoded SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func newS3Source(u *url.URL, opts Options) (*HTTPSource, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q (want s3://bucket/key)", u.String())
+	}
+	c, e := opts.httpClient()
+	if e != nil {
+		return nil, e
+	}
+	conf := opts.S3
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	endpoint := strings.TrimSuffix(conf.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", conf.Region)
+	}
+	s := &HTTPSource{
+		URL:     fmt.Sprintf("%v/%v/%v", endpoint, s3Escape(u.Host, false), s3Escape(key, true)),
+		Options: opts,
+		client:  httpClient{c: c},
+	}
+	if conf.AccessKeyID != "" {
+		s.client.sign = s3Signer{S3Config: conf, now: time.Now}.sign
+	}
+	return s, nil
+}
+
+// s3Signer authenticates requests with AWS Signature Version 4.
+type s3Signer struct {
+	S3Config
+	now func() time.Time
+}
+
+func (s s3Signer) sign(req *http.Request) {
+	t := s.now().UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders string
+	for _, k := range names {
+		canonHeaders += k + ":" + headers[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders,
+		signed,
+		emptySHA256,
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, s.Region)
+	reqSum := sha256.Sum256([]byte(canonReq))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		req.Header.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(reqSum[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, v := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v,SignedHeaders=%v,Signature=%x",
+		s.AccessKeyID, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters
+// (and slashes if keepSlash is set), as required by AWS signatures.
+func s3Escape(s string, keepSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package imgsrc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Source is a file containing a disk image.
+type Source interface {
+	// Open returns a reader for the whole file, starting at its first byte.
+	Open() (io.ReadCloser, error)
+	// Size returns the size of the file in bytes, or -1 if it is not known in advance.
+	Size() (int64, error)
+}
+
+// RandomAccessSource is a Source which can also be read at arbitrary offsets.
+// ReadAt may be called concurrently. Close releases what ReadAt keeps open,
+// readers returned by Open have to be closed separately.
+type RandomAccessSource interface {
+	Source
+	io.ReaderAt
+	io.Closer
+}
+
+// Options configures how sources access their files.
+type Options struct {
+	// MaxRetries limits how often a network source may reconnect after
+	// errors, separately for the streaming reader and for random access.
+	MaxRetries int
+	OnRetry    RetryFunc // may be nil
+
+	// CACerts are PEM encoded certificates of the CAs which are trusted
+	// for HTTPS (including S3). If empty, the system CAs are trusted.
+	CACerts []byte
+
+	// S3 configures access to s3:// URLs.
+	S3 S3Config
+}
+
+// httpClient returns the client for HTTP requests of network sources.
+func (o Options) httpClient() (*http.Client, error) {
+	if len(o.CACerts) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(o.CACerts) {
+		return nil, fmt.Errorf("no valid CA certificates found")
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}, nil
+}
+
+// New returns a source for an image URL. Supported URLs are
+// http://, https://, s3://bucket/key, file://, plain local paths
+// and "-" or "stdin:" for standard input.
+func New(rawURL string, opts Options) (Source, error) {
+	if rawURL == "-" {
+		return &StdinSource{}, nil
+	}
+	u, e := url.Parse(rawURL)
+	if e != nil {
+		return nil, fmt.Errorf("invalid image URL %q: %v", rawURL, e)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		c, e := opts.httpClient()
+		if e != nil {
+			return nil, e
+		}
+		return &HTTPSource{URL: rawURL, Options: opts, client: httpClient{c: c}}, nil
+	case "s3":
+		return newS3Source(u, opts)
+	case "stdin":
+		return &StdinSource{}, nil
+	case "file":
+		return &FileSource{Path: u.Path}, nil
+	case "":
+		return &FileSource{Path: rawURL}, nil
+	}
+	return nil, fmt.Errorf("unsupported image URL scheme %q", u.Scheme)
+}
+
+// FileSource reads an image from a local file (eg. on a USB stick or NFS mount).
+type FileSource struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File // opened by the first ReadAt
+}
+
+func (s *FileSource) Open() (io.ReadCloser, error) {
+	return os.Open(s.Path)
+}
+
+func (s *FileSource) Size() (int64, error) {
+	fi, e := os.Stat(s.Path)
+	if e != nil {
+		return 0, e
+	}
+	return fi.Size(), nil
+}
+
+func (s *FileSource) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	if s.f == nil {
+		f, e := os.Open(s.Path)
+		if e != nil {
+			s.mu.Unlock()
+			return 0, e
+		}
+		s.f = f
+	}
+	f := s.f
+	s.mu.Unlock()
+	return f.ReadAt(p, off)
+}
+
+// Close closes the file used by ReadAt.
+func (s *FileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	e := s.f.Close()
+	s.f = nil
+	return e
+}
+
+// StdinSource reads an image which is piped into the agent.
+// It can only be opened once, since the data can't be read again.
+type StdinSource struct {
+	mu     sync.Mutex
+	opened bool
+}
+
+func (s *StdinSource) Open() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opened {
+		return nil, fmt.Errorf("standard input can only be read once")
+	}
+	s.opened = true
+	return ioutil.NopCloser(os.Stdin), nil
+}
+
+func (s *StdinSource) Size() (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,165 @@
+package imgsrc_test
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/imgsrc"
+)
+
+func TestNew(t *testing.T) {
+	dir, e := ioutil.TempDir("", "imgsrc")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "disk.img")
+	data := []byte("walrus disk image")
+	if e := ioutil.WriteFile(path, data, 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	cases := []struct {
+		url        string
+		expFile    bool
+		shouldFail bool
+	}{
+		{path, true, false},
+		{"file://" + path, true, false},
+		{"http://example.com/disk.img", false, false},
+		{"https://example.com/disk.img", false, false},
+		{"s3://bucket/disk.img", false, false},
+		{"s3://bucket", false, true},
+		{"gopher://example.com/disk.img", false, true},
+	}
+	for _, c := range cases {
+		s, e := imgsrc.New(c.url, imgsrc.Options{})
+		if c.shouldFail {
+			if e == nil {
+				t.Errorf("%v: got no error, want some error", c.url)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%v: unexpected error: %v", c.url, e)
+			continue
+		}
+		if _, ok := s.(imgsrc.RandomAccessSource); !ok {
+			t.Errorf("%v: got source without random access", c.url)
+		}
+		if !c.expFile {
+			continue
+		}
+		r, e := s.Open()
+		if e != nil {
+			t.Errorf("%v: unexpected error while opening: %v", c.url, e)
+			continue
+		}
+		act, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(act, data) {
+			t.Errorf("%v: got %q, want %q", c.url, act, data)
+		}
+		p := make([]byte, 4)
+		if _, e := s.(imgsrc.RandomAccessSource).ReadAt(p, 7); e != nil || string(p) != "disk" {
+			t.Errorf("%v: got (%q, %v) from ReadAt, want \"disk\"", c.url, p, e)
+		}
+		if n, e := s.Size(); e != nil || n != int64(len(data)) {
+			t.Errorf("%v: got size (%v, %v), want %v", c.url, n, e, len(data))
+		}
+	}
+}
+
+func TestFileSourceReadAt(t *testing.T) {
+	dir, e := ioutil.TempDir("", "imgsrc")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "disk.img")
+	if e := ioutil.WriteFile(path, []byte("walrus disk image"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	s := &imgsrc.FileSource{Path: path}
+	p := make([]byte, 4)
+	if _, e := s.ReadAt(p, 7); e != nil || string(p) != "disk" {
+		t.Fatalf("got (%q, %v) from ReadAt, want \"disk\"", p, e)
+	}
+	// The file stays open, so it can still be read after being removed.
+	if e := os.Remove(path); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := s.ReadAt(p, 0); e != nil || string(p) != "walr" {
+		t.Errorf("got (%q, %v) from ReadAt of removed file, want \"walr\"", p, e)
+	}
+	if e := s.Close(); e != nil {
+		t.Errorf("unexpected error while closing: %v", e)
+	}
+	if _, e := s.ReadAt(p, 0); e == nil {
+		t.Errorf("got no error from ReadAt after Close of removed file, want some error")
+	}
+}
+
+func TestNewStdin(t *testing.T) {
+	for _, u := range []string{"-", "stdin:"} {
+		s, e := imgsrc.New(u, imgsrc.Options{})
+		if e != nil {
+			t.Errorf("%v: unexpected error: %v", u, e)
+			continue
+		}
+		if _, ok := s.(imgsrc.RandomAccessSource); ok {
+			t.Errorf("%v: got source with random access", u)
+		}
+		if n, e := s.Size(); e != nil || n != -1 {
+			t.Errorf("%v: got size (%v, %v), want -1", u, n, e)
+		}
+		if _, e := s.Open(); e != nil {
+			t.Errorf("%v: unexpected error while opening: %v", u, e)
+		}
+		if _, e := s.Open(); e == nil {
+			t.Errorf("%v: got no error when opening twice, want some error", u)
+		}
+	}
+}
+
+func TestNewCACerts(t *testing.T) {
+	data := []byte("walrus disk image")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	s, e := imgsrc.New(srv.URL, imgsrc.Options{})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if _, e := s.Open(); e == nil {
+		t.Errorf("got no error without CA certificate, want some error")
+	}
+
+	s, e = imgsrc.New(srv.URL, imgsrc.Options{CACerts: caPEM})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	r, e := s.Open()
+	if e != nil {
+		t.Fatalf("unexpected error while opening: %v", e)
+	}
+	act, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(act, data) {
+		t.Errorf("got %q, want %q", act, data)
+	}
+
+	if _, e := imgsrc.New(srv.URL, imgsrc.Options{CACerts: []byte("walrus")}); e == nil {
+		t.Errorf("got no error for invalid CA certificates, want some error")
+	}
+}
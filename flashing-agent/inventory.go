@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tehwalris/ghw"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/efivars"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/sysinfo"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// readInventory describes the disks, NICs, CPU, memory and identity of the machine.
+// Disks with a GPT which can't be read are still included.
+func readInventory() (*pb.Inventory, error) {
+	inv := &pb.Inventory{
+		System: sysinfo.ReadSystemIdentity(),
+		Efi:    efivars.IsEFIBooted(),
+	}
+	bl, e := ghw.Block()
+	if e != nil {
+		return nil, fmt.Errorf("while reading block devices: %v", e)
+	}
+	for _, d := range bl.Disks {
+		pd := &pb.Inventory_Disk{
+			Name:              d.Name,
+			CombinedSerial:    d.SerialNumber,
+			Wwn:               d.WWN,
+			Vendor:            d.Vendor,
+			Model:             d.Model,
+			Size:              d.SizeBytes,
+			SectorSize:        d.SectorSizeBytes,
+			PhysicalBlockSize: d.PhysicalBlockSizeBytes,
+		}
+		if table, e := disk.ReadGpt(d); e != nil {
+			pd.GptError = e.Error()
+		} else if table != nil {
+			pd.Gpt = tableToPb(table)
+		}
+		inv.Disks = append(inv.Disks, pd)
+	}
+	n, e := ghw.Network()
+	if e != nil {
+		return nil, fmt.Errorf("while reading network devices: %v", e)
+	}
+	for _, nic := range n.NICs {
+		inv.Nics = append(inv.Nics, &pb.Inventory_Nic{
+			Name:       nic.Name,
+			MacAddress: nic.MacAddress,
+			Virtual:    nic.IsVirtual,
+			SpeedMbps:  sysinfo.LinkSpeed(nic.Name),
+		})
+	}
+	if inv.Cpu, e = sysinfo.ReadCPU(); e != nil {
+		return nil, fmt.Errorf("while reading CPU info: %v", e)
+	}
+	if inv.MemoryBytes, e = sysinfo.ReadMemoryBytes(); e != nil {
+		return nil, fmt.Errorf("while reading memory info: %v", e)
+	}
+	return inv, nil
+}
+
+// inventoryTimeout limits how long sending the inventory may delay GetCommand.
+const inventoryTimeout = 5 * time.Second
+
+// reportInventory logs the inventory and sends it to the supervisor.
+// It is called before there is a session.
+func reportInventory(logger *superlog.Logger, c pb.FlashingSupervisorClient) error {
+	inv, e := readInventory()
+	if e != nil {
+		return e
+	}
+	s := inv.System
+	logger.Logf("system: %v %v (serial %q, UUID %v), EFI: %v",
+		s.SysVendor, s.ProductName, s.ProductSerial, s.ProductUuid, inv.Efi)
+	logger.Logf("CPU: %v (%v sockets, %v cores, %v threads), memory: %v bytes",
+		inv.Cpu.Model, inv.Cpu.Sockets, inv.Cpu.Cores, inv.Cpu.Threads, inv.MemoryBytes)
+	for _, d := range inv.Disks {
+		layout := fmt.Sprintf("%v GPT partitions", len(d.Gpt.GetPartitions()))
+		if d.GptError != "" {
+			layout = fmt.Sprintf("bad GPT: %v", d.GptError)
+		} else if d.Gpt == nil {
+			layout = "no GPT"
+		}
+		logger.Logf("disk %v: serial %v, model %v, %v bytes, %v",
+			d.Name, d.CombinedSerial, d.Model, d.Size, layout)
+	}
+	for _, nic := range inv.Nics {
+		logger.Logf("NIC %v: MAC %v, %v Mbit/s", nic.Name, nic.MacAddress, nic.SpeedMbps)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryTimeout)
+	defer cancel()
+	_, e = c.ReportInventory(ctx, &pb.ReportInventoryRequest{Inventory: inv})
+	return e
+}
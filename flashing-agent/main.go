@@ -3,42 +3,270 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
+	"sort"
 	"time"
 
 	"github.com/rekby/gpt"
-	"github.com/tehwalris/ghw"
 
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/bmap"
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/delta"
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/efivars"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/imgsrc"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/mcast"
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/qcow2"
 	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/throttle"
 	pb "git.dolansoft.org/philippe/softmetal/pb"
 	"google.golang.org/grpc"
 )
 
 var managerHP = flag.String("manager", "", "host and GRPC port of flashing manager (required)")
+var dryRunFlag = flag.Bool("dry-run", false, "only report the planned changes, even if the manager requests flashing")
 
 // gptBufferSize is the maximum number of bytes to load from
 // the start of the image for extracting the GPT.
 const gptBufferSize = 1000 * 1000
 
+// defaultAlignment is the default alignment of new partitions in bytes.
+const defaultAlignment = 1024 * 1024
+
 const initialRetryCount = 10
 const initialRetryDelay = 5 * time.Second
 
-func flash(logger *superlog.Logger, config *pb.FlashingConfig) error {
+// bandwidthPollInterval is how often the bandwidth limit is requested from the supervisor.
+const bandwidthPollInterval = 10 * time.Second
+
+// newSource returns the source for a URL from imgConf (the image or a file
+// describing it), configured for access like the image itself.
+func newSource(
+	imgConf *pb.FlashingConfig_ImageConfig, rawURL string, onRetry imgsrc.RetryFunc,
+) (imgsrc.Source, error) {
+	opts := imgsrc.Options{
+		MaxRetries: int(imgConf.MaxRetries),
+		OnRetry:    onRetry,
+		CACerts:    []byte(imgConf.CaCertsPem),
+	}
+	if s3 := imgConf.S3; s3 != nil {
+		opts.S3 = imgsrc.S3Config{
+			Endpoint:        s3.Endpoint,
+			Region:          s3.Region,
+			AccessKeyID:     s3.AccessKeyId,
+			SecretAccessKey: s3.SecretAccessKey,
+		}
+	}
+	return imgsrc.New(rawURL, opts)
+}
+
+// qcow2ReadSize is how much of the virtual disk is read from qcow2 images at once.
+// Reads are large, since every read can be an HTTP request.
+const qcow2ReadSize = 4 * 1024 * 1024
+
+// openImage requests the image and returns a reader for its uncompressed contents.
+// Downloads are throttled by limiter before decompression, multicast is not.
+func openImage(
+	logger *superlog.Logger, imgConf *pb.FlashingConfig_ImageConfig, limiter *throttle.Limiter,
+) (io.ReadCloser, error) {
+	onRetry := func(offset uint64, retry int, e error) {
+		logger.Logf("image download failed at byte %v (retry %v of %v): %v",
+			offset, retry, imgConf.MaxRetries, e)
+	}
+	src, e := newSource(imgConf, imgConf.Url, onRetry)
+	if e != nil {
+		return nil, e
+	}
+	if size, e := src.Size(); e != nil {
+		logger.Logf("failed to get image file size: %v", e)
+	} else if size >= 0 {
+		logger.Logf("image file size: %v bytes", size)
+	}
+
+	switch imgConf.Format {
+	case pb.ImageFormat_RAW:
+		var sr io.ReadCloser
+		if imgConf.MulticastGroup != "" {
+			// The sender sets the rate of multicast.
+			sr, e = openMulticast(logger, imgConf, src)
+		} else if sr, e = src.Open(); e == nil {
+			sr = readCloser{limiter.Reader(sr), sr}
+		}
+		if e != nil {
+			return nil, e
+		}
+		r, e := imgsrc.Decompress(sr, imgConf.Compression)
+		if e != nil {
+			sr.Close()
+			return nil, e
+		}
+		return r, nil
+	case pb.ImageFormat_QCOW2:
+		if c := imgConf.Compression; c != pb.Compression_AUTO_DETECT && c != pb.Compression_NO_COMPRESSION {
+			return nil, fmt.Errorf("qcow2 images can't use compression %v", c)
+		}
+		ra, ok := src.(imgsrc.RandomAccessSource)
+		if !ok {
+			return nil, fmt.Errorf("image source does not support random access (required for qcow2)")
+		}
+		img, e := qcow2.Open(limiter.ReaderAt(ra))
+		if e != nil {
+			ra.Close()
+			return nil, e
+		}
+		logger.Logf("qcow2 image has virtual size %v bytes", img.Size())
+		sr := io.NewSectionReader(img, 0, int64(img.Size()))
+		return readCloser{bufio.NewReaderSize(sr, qcow2ReadSize), qcow2Closer{img, ra}}, nil
+	}
+	return nil, fmt.Errorf("unsupported image format %v", imgConf.Format)
+}
+
+// readCloser reads from a wrapper of what Closer closes.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// qcow2Closer closes a qcow2 image and its source.
+type qcow2Closer struct {
+	img *qcow2.Image
+	ra  imgsrc.RandomAccessSource
+}
+
+func (c qcow2Closer) Close() error {
+	c.img.Close()
+	return c.ra.Close()
+}
+
+// multicastReader logs where the image data came from when it is closed.
+type multicastReader struct {
+	*mcast.Receiver
+	fallback imgsrc.RandomAccessSource
+	logger   *superlog.Logger
+}
+
+func (r multicastReader) Close() error {
+	s := r.Stats()
+	r.logger.Logf("multicast: received %v bytes, recovered %v bytes, downloaded %v bytes",
+		s.Multicast, s.Recovered, s.Fallback)
+	e := r.Receiver.Close()
+	if fe := r.fallback.Close(); e == nil {
+		e = fe
+	}
+	return e
+}
+
+// openMulticast joins the multicast group of the image and returns a reader
+// for the image file. Data which is lost is downloaded from src instead.
+func openMulticast(
+	logger *superlog.Logger, imgConf *pb.FlashingConfig_ImageConfig, src imgsrc.Source,
+) (io.ReadCloser, error) {
+	ra, ok := src.(imgsrc.RandomAccessSource)
+	if !ok {
+		return nil, fmt.Errorf("image source does not support random access (required for multicast)")
+	}
+	size, e := ra.Size()
+	if e != nil {
+		return nil, fmt.Errorf("while getting image file size: %v", e)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("multicast requires an image source with known size")
+	}
+	conn, e := mcast.Join(imgConf.MulticastGroup)
+	if e != nil {
+		return nil, fmt.Errorf("while joining multicast group %v: %v", imgConf.MulticastGroup, e)
+	}
+	logger.Logf("receiving image from multicast group %v (stream %v)",
+		imgConf.MulticastGroup, imgConf.MulticastStreamId)
+	r := mcast.NewReceiver(conn, ra, uint64(size), mcast.ReceiveOptions{StreamID: imgConf.MulticastStreamId})
+	return multicastReader{r, ra, logger}, nil
+}
+
+// openRandomAccess returns the image source for parallel and delta downloads.
+// It fails if the image can't be read at arbitrary offsets without decompressing it.
+func openRandomAccess(
+	logger *superlog.Logger, imgConf *pb.FlashingConfig_ImageConfig,
+) (imgsrc.RandomAccessSource, error) {
+	if imgConf.Format != pb.ImageFormat_RAW {
+		return nil, fmt.Errorf("range downloads require a raw image (got %v)", imgConf.Format)
+	}
+	if imgConf.Sha256 != "" || imgConf.BmapUrl != "" {
+		return nil, fmt.Errorf("range downloads can't be combined with image or block map checksums")
+	}
+	if imgConf.MulticastGroup != "" {
+		return nil, fmt.Errorf("range downloads can't be combined with multicast")
+	}
+	onRetry := func(offset uint64, retry int, e error) {
+		logger.Logf("image request at byte %v failed (retry %v of %v): %v",
+			offset, retry, imgConf.MaxRetries, e)
+	}
+	src, e := newSource(imgConf, imgConf.Url, onRetry)
+	if e != nil {
+		return nil, e
+	}
+	ra, ok := src.(imgsrc.RandomAccessSource)
+	if !ok {
+		return nil, fmt.Errorf("image source does not support random access (required for range downloads)")
+	}
+	c := imgConf.Compression
+	if c == pb.Compression_AUTO_DETECT {
+		header := make([]byte, 8) // longer than all magic numbers
+		n, e := ra.ReadAt(header, 0)
+		if e != nil && e != io.EOF {
+			ra.Close()
+			return nil, fmt.Errorf("while detecting compression: %v", e)
+		}
+		c = imgsrc.DetectCompression(header[:n])
+	}
+	if c != pb.Compression_NO_COMPRESSION {
+		ra.Close()
+		return nil, fmt.Errorf("range downloads require an uncompressed image (got %v)", c)
+	}
+	return ra, nil
+}
+
+func readDeltaManifest(imgConf *pb.FlashingConfig_ImageConfig) (*delta.Manifest, error) {
+	src, e := newSource(imgConf, imgConf.DeltaManifestUrl, nil)
+	if e != nil {
+		return nil, e
+	}
+	r, e := src.Open()
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	return delta.Parse(r)
+}
+
+func readBmap(imgConf *pb.FlashingConfig_ImageConfig) (*bmap.Bmap, error) {
+	src, e := newSource(imgConf, imgConf.BmapUrl, nil)
+	if e != nil {
+		return nil, e
+	}
+	r, e := src.Open()
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	return bmap.Parse(r)
+}
+
+// flash writes the image to the disk. In dry-run mode, it only reports
+// the planned changes, without opening the disk for writing or writing EFI variables.
+func flash(logger *superlog.Logger, config *pb.FlashingConfig, limiter *throttle.Limiter, dryRun bool) error {
 	if config.ImageConfig == nil {
 		return fmt.Errorf("FlashingConfig.ImageConfig is required")
 	}
+	logger.Track(pb.FlashingPhase_PREPARING, 0)
 
 	isEFI := efivars.IsEFIBooted()
 	if !isEFI {
@@ -52,44 +280,115 @@ func flash(logger *superlog.Logger, config *pb.FlashingConfig) error {
 		return fmt.Errorf("machine must be EFI booted to set boot entries")
 	}
 
-	logger.Logf("using disk with serial %v", config.TargetDiskCombinedSerial)
-	diskF, diskInfo, e := disk.OpenBySerial(config.TargetDiskCombinedSerial)
-	if e != nil {
-		return e
+	var imgSum []byte
+	if config.ImageConfig.Sha256 != "" {
+		var e error
+		if imgSum, e = imgsrc.ParseSHA256(config.ImageConfig.Sha256); e != nil {
+			return e
+		}
+	} else {
+		log.Printf("WARNING: no image checksum specified in ImageConfig")
 	}
-	defer func() {
-		if e := diskF.Close(); e != nil {
-			logger.Logf("while closing disk: %v", e)
+
+	var bm *bmap.Bmap
+	if config.ImageConfig.BmapUrl != "" {
+		logger.Logf("using block map: %v", config.ImageConfig.BmapUrl)
+		var e error
+		if bm, e = readBmap(config.ImageConfig); e != nil {
+			return fmt.Errorf("while reading block map: %v", e)
 		}
-	}()
+	}
+
+	var manifest *delta.Manifest
+	if config.ImageConfig.DeltaManifestUrl != "" {
+		logger.Logf("using delta manifest: %v", config.ImageConfig.DeltaManifestUrl)
+		var e error
+		if manifest, e = readDeltaManifest(config.ImageConfig); e != nil {
+			return fmt.Errorf("while reading delta manifest: %v", e)
+		}
+	}
 
-	table, didCreateGpt, e := disk.GetOrCreateGpt(diskF, diskInfo)
+	tds, e := targetDisks(config)
 	if e != nil {
 		return e
 	}
-	if didCreateGpt {
-		logger.Logf("using new blank GPT table (no table found on disk)")
-	} else {
-		logger.Logf("using existing GPT table from disk")
+
+	var imgRA imgsrc.RandomAccessSource
+	rangeRequests := int(config.ImageConfig.ParallelDownloads)
+	if rangeRequests < 1 {
+		rangeRequests = 1
+	}
+	if rangeRequests > 1 || manifest != nil {
+		if len(tds) > 1 {
+			return fmt.Errorf("flashing %v disks requires a streamed image, "+
+				"which can't be combined with parallel_downloads or delta_manifest_url", len(tds))
+		}
+		logger.Logf("downloading image ranges with %v parallel requests", rangeRequests)
+		if imgRA, e = openRandomAccess(logger, config.ImageConfig); e != nil {
+			return e
+		}
+		defer imgRA.Close()
+		if manifest != nil {
+			size, e := imgRA.Size()
+			if e != nil {
+				return fmt.Errorf("while getting image size: %v", e)
+			}
+			if size < 0 {
+				return fmt.Errorf("image size is unknown, which is required for delta_manifest_url")
+			}
+			if uint64(size) != manifest.ImageSize {
+				return fmt.Errorf("image has %v bytes, but the delta manifest describes %v bytes", size, manifest.ImageSize)
+			}
+		}
+	}
+	var targets []*target
+	defer func() {
+		for _, t := range targets {
+			t.close(logger)
+		}
+	}()
+	for _, td := range tds {
+		t, e := openTarget(logger, td, dryRun, isEFI)
+		if e != nil {
+			return e
+		}
+		for _, o := range targets {
+			if o.info.Name == t.info.Name {
+				t.close(logger)
+				return fmt.Errorf("disk %v is selected more than once", t.info.Name)
+			}
+		}
+		targets = append(targets, t)
 	}
-	partition.PrintTable(table, logger, "Old GPT table from disk")
 
 	imgURL := config.ImageConfig.Url
 	logger.Logf("using image: %v", imgURL)
-	imgRes, e := http.Get(imgURL)
-	if e != nil {
-		return fmt.Errorf("while getting image (first): %v", e)
-	}
-
+	logger.Logf("image compression: %v", config.ImageConfig.Compression)
+	logger.Logf("image format: %v", config.ImageConfig.Format)
+	// The GPT is read from the start of the image. A streamed image is only
+	// downloaded once, so its buffered start is later replayed in front
+	// of the rest of the stream for the main copy.
 	var imgBuf bytes.Buffer
 	imgBuf.Grow(gptBufferSize)
-	_, e = io.CopyN(&imgBuf, imgRes.Body, gptBufferSize)
+	var imgR *imgsrc.DigestReader
+	if imgRA != nil {
+		_, e = io.Copy(&imgBuf, io.NewSectionReader(imgRA, 0, gptBufferSize))
+	} else {
+		var imgRC io.ReadCloser
+		if imgRC, e = openImage(logger, config.ImageConfig, limiter); e != nil {
+			return fmt.Errorf("while getting image: %v", e)
+		}
+		defer func() {
+			if e := imgRC.Close(); e != nil {
+				log.Printf("WARNING: failed to close image (%v): %v", imgURL, e)
+			}
+		}()
+		imgR = imgsrc.NewSHA256Reader(imgRC)
+		_, e = io.CopyN(&imgBuf, imgR, gptBufferSize)
+	}
 	if e != nil && e != io.EOF {
 		return fmt.Errorf("while buffering: %v", e)
 	}
-	if e := imgRes.Body.Close(); e != nil {
-		return fmt.Errorf("while closing image: %v", e)
-	}
 
 	imgSS := config.ImageConfig.SectorSize
 	if imgSS < 512 {
@@ -105,81 +404,204 @@ func flash(logger *superlog.Logger, config *pb.FlashingConfig) error {
 	}
 	partition.PrintTable(&imgTable, logger, "GPT table from image")
 
-	pers := make([]pb.FlashingConfig_Partition, len(config.PersistentPartitions))
-	for i, p := range config.PersistentPartitions {
-		pers[i] = *p
-	}
-	if e := copyimg.MergeGpt(table, &imgTable, pers); e != nil {
-		return fmt.Errorf("while merging GPT: %v", e)
-	}
-	partition.PrintTable(table, logger, "Merged GPT")
-
-	if e := table.Write(diskF); e != nil {
-		return fmt.Errorf("while writing disk-start GPT: %v", e)
-	}
-	if e := table.CreateOtherSideTable().Write(diskF); e != nil {
-		return fmt.Errorf("while writing disk-end GPT: %v", e)
+	var unchanged uint64
+	for _, t := range targets {
+		logger.Logf("planning disk with serial %v", t.serial)
+		if e := t.merge(logger, config, &imgTable); e != nil {
+			return e
+		}
+		if t.tasks, e = copyimg.PlanFromGPTs(t.table, &imgTable); e != nil {
+			return fmt.Errorf("while planning copy: %v", e)
+		}
+		if t != targets[0] {
+			if e := t.renewESPGuid(logger, &imgTable); e != nil {
+				return fmt.Errorf("while creating ESP GUID: %v", e)
+			}
+		}
+		if bm != nil {
+			t.unmapped = bm.Unmapped(t.tasks)
+			t.tasks = bm.Intersect(t.tasks)
+		}
+		if manifest != nil {
+			logger.Logf("comparing disk contents to delta manifest")
+			unmoved, moved := delta.Unmoved(&t.oldTable, t.table, t.tasks)
+			changed, same, e := manifest.Changed(t.f, unmoved)
+			if e != nil {
+				return fmt.Errorf("while comparing disk to delta manifest: %v", e)
+			}
+			t.tasks = append(moved, changed...)
+			unchanged = same
+		}
+		if config.Discard != pb.DiscardMode_NO_DISCARD {
+			t.discards, e = discardRanges(&t.oldTable, t.table, t.pers, t.tasks, config.DiscardAfterCopy)
+			if e != nil {
+				return fmt.Errorf("while planning discard: %v", e)
+			}
+		}
 	}
-	if e := disk.WritePMBR(diskF, diskInfo.SectorSizeBytes, diskInfo.SizeBytes); e != nil {
-		return fmt.Errorf("while writing protective MBR: %v", e)
+	if dryRun {
+		var up *efivars.Update
+		if bootEnt != nil {
+			if up, e = planBootUpdate(logger, bootEnt, targets); e != nil {
+				return e
+			}
+		}
+		for i, t := range targets {
+			p := planToPb(&t.oldTable, t.table, t.tasks, t.discards, up)
+			p.DiskCombinedSerial = t.serial
+			if i > 0 {
+				p.BootEntries, p.BootOrder = nil, nil
+			}
+			if e := logger.Plan(p); e != nil {
+				return fmt.Errorf("while sending plan: %v", e)
+			}
+		}
+		logger.Logf("dry run: nothing was written")
+		return nil
 	}
-
-	cpTasks, e := copyimg.PlanFromGPTs(table, &imgTable)
-	if e != nil {
-		return fmt.Errorf("while planning copy: %v", e)
+	// Disks are only written once all of them could be planned.
+	for _, t := range targets {
+		if e := t.writeTable(); e != nil {
+			return e
+		}
 	}
-	cpTasks = copyimg.SplitTasks(cpTasks, 100)
-	imgRes, e = http.Get(imgURL)
-	if e != nil {
-		return fmt.Errorf("while getting image (second): %v", e)
+	for _, t := range targets {
+		if t.discards != nil && !config.DiscardAfterCopy {
+			if e := discard(logger, disk.Device{File: t.f}, t.discards, t.table.SectorSize, config.Discard); e != nil {
+				return e
+			}
+		}
 	}
 
 	var total uint64
-	for _, t := range cpTasks {
-		total += t.Size
+	for _, t := range targets {
+		// Splits are sector aligned, so that writes with O_DIRECT stay aligned.
+		t.tasks = copyimg.SplitTasksAligned(t.tasks, 100, t.table.SectorSize)
+		for _, task := range t.tasks {
+			total += task.Size
+		}
 	}
+	// Tasks are copied roughly in source order, which is used to
+	// guess which partition is being written. All disks of a mirror
+	// progress together, so only the first one is used for this.
+	first := targets[0]
+	srcOrder := append([]copyimg.Task(nil), first.tasks...)
+	sort.Slice(srcOrder, func(i, j int) bool { return srcOrder[i].Src < srcOrder[j].Src })
+	tracker := logger.Track(pb.FlashingPhase_COPYING, total)
 	progC := make(chan uint64, 50)
-	var cur uint64
+	progDone := make(chan struct{})
 	go func() {
+		defer close(progDone)
+		var cur, started uint64
+		next := 0 // index in srcOrder of the first task which is not done
 		for v := range progC {
 			cur += v
-			logger.Progress(float32(cur) / float32(total))
+			for next < len(srcOrder) && started+srcOrder[next].Size <= cur/uint64(len(targets)) {
+				started += srcOrder[next].Size
+				next++
+			}
+			var part string
+			if next < len(srcOrder) {
+				part = partitionAt(first.table, srcOrder[next].Dst)
+			}
+			tracker.Add(v, part)
 		}
 	}()
 
-	if e := copyimg.CopyToSeeker(diskF, imgRes.Body, cpTasks, progC); e != nil {
+	cpStats := make([]copyimg.Stats, len(targets))
+	dsts := make([]copyimg.Destination, len(targets))
+	for i, t := range targets {
+		cpOpts := copyimg.Options{Stats: &cpStats[i], SectorSize: t.table.SectorSize}
+		switch config.ZeroBlocks {
+		case pb.ZeroBlockMode_ZERO_OUT:
+			cpOpts.ZeroMode = copyimg.ZeroOut
+			serial := t.serial
+			cpOpts.OnZeroUnsupported = func(e error) {
+				logger.Logf("disk %v does not support zeroing out (%v), writing zero blocks instead", serial, e)
+			}
+		case pb.ZeroBlockMode_SKIP_ZEROS:
+			cpOpts.ZeroMode = copyimg.SkipZeros
+		}
+		if config.VerifyWritten {
+			cpOpts.Sums = make([]copyimg.Checksum, len(t.tasks))
+		}
+		cpF := t.f
+		if config.DirectIo {
+			if cpF, e = disk.OpenDirect(t.f); e != nil {
+				return fmt.Errorf("while opening disk with O_DIRECT: %v", e)
+			}
+			defer cpF.Close()
+		}
+		dsts[i] = copyimg.Destination{W: disk.Device{File: cpF}, Tasks: t.tasks, Opts: cpOpts}
+	}
+	var bmR *bmap.VerifyingReader
+	if imgRA != nil {
+		d := dsts[0]
+		e = copyimg.CopyParallel(d.W, limiter.ReaderAt(imgRA), d.Tasks, rangeRequests, progC, d.Opts)
+	} else {
+		var imgFullR io.Reader = io.MultiReader(bytes.NewReader(imgBuf.Bytes()), imgR)
+		if bm != nil {
+			bmR = bm.NewVerifyingReader(imgFullR)
+			imgFullR = bmR
+		}
+		e = copyimg.CopyMulti(dsts, imgFullR, progC)
+	}
+	<-progDone
+	if e != nil {
 		return fmt.Errorf("during main copy operation: %v", e)
 	}
-	if e := imgRes.Body.Close(); e != nil {
-		log.Printf("WARNING: failed to close image (%v) after copy: %v", imgURL, e)
+	for i, t := range targets {
+		var size uint64
+		for _, task := range t.tasks {
+			size += task.Size
+		}
+		logger.Logf("copied %v bytes to disk %v (%v written, %v zeroed out, %v skipped)",
+			size, t.serial, cpStats[i].Written, cpStats[i].Zeroed, cpStats[i].Skipped)
 	}
-
-	if bootEnt != nil {
-		logger.Logf("configuring boot entries")
-		oldOrd, e := efivars.ReadBootOrder()
-		if e != nil {
-			return fmt.Errorf("while reading boot order: %v", e)
+	if manifest != nil {
+		logger.Logf("delta: skipped %v unchanged bytes, copied %v changed bytes", unchanged, total)
+	}
+	if bmR != nil {
+		if e := bmR.Finish(); e != nil {
+			return fmt.Errorf("while verifying block map checksums: %v", e)
 		}
-		oldEnts, e := efivars.ReadBootEntries()
-		if e != nil {
-			return fmt.Errorf("while reading boot entries: %v", e)
+		if config.ImageConfig.DiscardUnmapped {
+			for _, t := range targets {
+				discardUnmapped(logger, disk.Device{File: t.f}, t.unmapped)
+			}
 		}
-		logger.Logf("old boot order: %04X", oldOrd)
-		logger.Logf("old boot entries:")
-		for k, v := range oldEnts {
-			logger.Logf(" %04X %v", k, v.Description)
+	}
+	if imgSum != nil {
+		logger.Logf("verifying image checksum")
+		if e := imgR.Verify(imgSum); e != nil {
+			return e
 		}
-
-		newEnt, e := efivars.NewBootEntry(bootEnt.Path, table.Partitions)
-		if e != nil {
-			return fmt.Errorf("while creating boot entry in-memory: %v", e)
+	}
+	if manifest != nil {
+		if e := verifyDelta(logger, manifest, targets[0]); e != nil {
+			return e
 		}
+	}
 
-		up, e := efivars.PlanUpdate(*oldOrd, oldEnts, *newEnt)
-		logger.Logf("boot config changes: %+v", up)
+	for i, t := range targets {
+		if config.VerifyWritten {
+			if e := verifyWritten(logger, t.f, t.table, t.tasks, dsts[i].Opts.Sums); e != nil {
+				return e
+			}
+		}
+		if t.discards != nil && config.DiscardAfterCopy {
+			if e := discard(logger, disk.Device{File: t.f}, t.discards, t.table.SectorSize, config.Discard); e != nil {
+				return e
+			}
+		}
+	}
 
+	if bootEnt != nil {
+		logger.Track(pb.FlashingPhase_FINISHING, 0)
+		logger.Logf("configuring boot entries")
+		up, e := planBootUpdate(logger, bootEnt, targets)
 		if e != nil {
-			return fmt.Errorf("while planning update: %v", e)
+			return e
 		}
 		if e := efivars.WriteBootEntries(up.Write); e != nil {
 			return fmt.Errorf("while writing boot entries: %v", e)
@@ -189,9 +611,92 @@ func flash(logger *superlog.Logger, config *pb.FlashingConfig) error {
 		}
 	}
 
-	// TODO alignment of merged partitions!
-	// TODO check that image is equal on second read
+	return nil
+}
+
+// discardUnmapped discards destination ranges which the block map does not cover.
+// Failures are only logged, since the ranges may be left as they are.
+func discardUnmapped(logger *superlog.Logger, dev disk.Device, unmapped []copyimg.Task) {
+	var total uint64
+	for _, t := range unmapped {
+		if e := dev.DiscardRange(t.Dst, t.Size); e != nil {
+			log.Printf("WARNING: failed to discard unmapped ranges: %v", e)
+			return
+		}
+		total += t.Size
+	}
+	logger.Logf("discarded %v unmapped bytes", total)
+}
+
+// partitionAt returns the unique GUID of the partition
+// containing the given byte offset, or "" if there is none.
+func partitionAt(table *gpt.Table, offset uint64) string {
+	if p := partition.FindContaining(table, offset/table.SectorSize); p != nil {
+		return p.Id.String()
+	}
+	return ""
+}
+
+// verifyWritten reads all copied data back from the disk and fails
+// if it does not match what was written.
+func verifyWritten(
+	logger *superlog.Logger, diskF *os.File, table *gpt.Table,
+	cpTasks []copyimg.Task, sums []copyimg.Checksum,
+) error {
+	var total uint64
+	for _, t := range cpTasks {
+		total += t.Size
+	}
+	tracker := logger.Track(pb.FlashingPhase_VERIFYING, total)
+	logger.Logf("verifying written data")
+	if e := disk.FlushCache(diskF); e != nil {
+		return fmt.Errorf("while flushing disk cache: %v", e)
+	}
+	bad, e := copyimg.Verify(diskF, cpTasks, sums)
+	if e != nil {
+		return fmt.Errorf("while verifying written data: %v", e)
+	}
+	tracker.Add(total, "")
+	if len(bad) == 0 {
+		return nil
+	}
+	badBytes := make(map[string]uint64)
+	for _, t := range bad {
+		id := partitionAt(table, t.Dst)
+		if id == "" {
+			id = "(no partition)"
+		}
+		badBytes[id] += t.Size
+	}
+	for id, n := range badBytes {
+		logger.Logf("verification failed for partition %v (%v bytes in mismatching regions)", id, n)
+	}
+	return fmt.Errorf("written data does not match image in %v regions", len(bad))
+}
 
+// verifyDelta compares the data written to t to the delta manifest,
+// since range downloads can't be checked against an image checksum.
+func verifyDelta(logger *superlog.Logger, m *delta.Manifest, t *target) error {
+	var total uint64
+	for _, task := range t.tasks {
+		total += task.Size
+	}
+	tracker := logger.Track(pb.FlashingPhase_VERIFYING, total)
+	logger.Logf("verifying written data against delta manifest")
+	if e := disk.FlushCache(t.f); e != nil {
+		return fmt.Errorf("while flushing disk cache: %v", e)
+	}
+	bad, unchecked, e := m.Verify(t.f, t.tasks)
+	if e != nil {
+		return fmt.Errorf("while verifying written data: %v", e)
+	}
+	tracker.Add(total, "")
+	if unchecked > 0 {
+		logger.Logf("delta: %v bytes are only part of a manifest block and were not verified", unchecked)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%v written blocks do not match the delta manifest", bad)
+	}
 	return nil
 }
 
@@ -206,29 +711,36 @@ func powerControl(t pb.PowerControlType) error {
 	return exec.Command(cmd).Run()
 }
 
-func logSysinfo(logger *superlog.Logger) error {
-	bl, e := ghw.Block()
-	if e != nil {
-		return e
-	}
-	logger.Logf("block info: %v", bl.String())
-	logger.Logf("  disks:")
-	for _, d := range bl.Disks {
-		logger.Logf("    %v", d.String())
-		for _, p := range d.Partitions {
-			logger.Logf("      %v", p.String())
+// pollBandwidthLimit updates the rate of limiter from the supervisor until stop is closed.
+func pollBandwidthLimit(
+	logger *superlog.Logger, c pb.FlashingSupervisorClient, sessID uint64,
+	limiter *throttle.Limiter, stop <-chan struct{},
+) {
+	t := time.NewTicker(bandwidthPollInterval)
+	defer t.Stop()
+	failed := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), bandwidthPollInterval)
+		l, e := c.GetBandwidthLimit(ctx, &pb.GetBandwidthLimitRequest{SessionId: sessID})
+		cancel()
+		if e != nil {
+			if !failed {
+				logger.Logf("failed to get bandwidth limit: %v", e)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+		if l.BytesPerSecond != limiter.Rate() {
+			logger.Logf("changing bandwidth limit to %v bytes/s", l.BytesPerSecond)
+			limiter.SetRate(l.BytesPerSecond)
 		}
 	}
-	n, e := ghw.Network()
-	if e != nil {
-		return e
-	}
-	logger.Logf("network info: %v", n.String())
-	logger.Logf("  NICs: ")
-	for _, v := range n.NICs {
-		logger.Logf("    %v", v.String())
-	}
-	return nil
 }
 
 func listen(logger *superlog.Logger) (pb.PowerControlType, error) {
@@ -251,6 +763,11 @@ func listen(logger *superlog.Logger) (pb.PowerControlType, error) {
 	}
 
 	c := pb.NewFlashingSupervisorClient(conn)
+	// Sent before the command is requested, so that the supervisor
+	// knows the machine even if it has nothing for it to do.
+	if e := reportInventory(logger, c); e != nil {
+		logger.Logf("failed to report inventory: %v", e)
+	}
 	cmd, e := c.GetCommand(context.Background(), &pb.Empty{})
 	if e != nil {
 		return defaultPowerControl, e
@@ -274,11 +791,34 @@ func listen(logger *superlog.Logger) (pb.PowerControlType, error) {
 		}
 	}()
 
-	if e = logSysinfo(logger); e != nil {
-		logger.Logf("failed to get system info: %v", e)
+	var rate uint64
+	if cmd.BandwidthLimit != nil {
+		rate = cmd.BandwidthLimit.BytesPerSecond
+		logger.Logf("bandwidth limit: %v bytes/s", rate)
+	}
+	limiter := throttle.New(rate)
+	stopPoll := make(chan struct{})
+	defer close(stopPoll)
+	go pollBandwidthLimit(logger, c, cmd.SessionId, limiter, stopPoll)
+
+	dryRun := cmd.DryRun || *dryRunFlag
+	if cmd.RestoreBackup != nil {
+		if dryRun {
+			e = fmt.Errorf("not restoring backup in dry-run mode")
+		} else {
+			e = restoreBackup(logger, cmd.RestoreBackup)
+		}
+		if e != nil {
+			logger.Logf("restore error: %v", e)
+			return cmd.PowerOnCompletion, e
+		}
+		ok = true
+		return cmd.PowerOnCompletion, nil
 	}
-
-	if e = flash(logger, cmd.Config); e != nil {
+	if dryRun {
+		logger.Logf("dry run: only planning changes")
+	}
+	if e = flash(logger, cmd.Config, limiter, dryRun); e != nil {
 		// Log this here so that supervisor gets it, since it will be detatched later.
 		logger.Logf("flashing error: %v", e)
 		return cmd.PowerOnCompletion, e
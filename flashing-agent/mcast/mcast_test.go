@@ -0,0 +1,207 @@
+package mcast
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/imgsrc"
+)
+
+// relay forwards packets from conn to each receiver, except those for which
+// drop returns true. Multicast is often not available on loopback interfaces,
+// so this stands in for the network.
+func relay(conn net.PacketConn, receivers []net.Addr, drops []func(header) bool) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, e := conn.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		h, _ := parseHeader(buf[:n])
+		for i, addr := range receivers {
+			if !drops[i](h) {
+				conn.WriteTo(buf[:n], addr)
+			}
+		}
+	}
+}
+
+func listen(t *testing.T) net.PacketConn {
+	conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return conn
+}
+
+func TestSendReceive(t *testing.T) {
+	const chunkSize = 1000
+	const groupSize = 8
+	img := make([]byte, 200*chunkSize+123)
+	rand.New(rand.NewSource(1)).Read(img)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "disk.img", time.Time{}, bytes.NewReader(img))
+	}))
+	defer srv.Close()
+
+	dataIndex := func(h header) (uint64, bool) { return h.index, h.kind == kindData }
+	cases := []struct {
+		label string
+		drop  func(header) bool
+		check func(ReceiveStats) bool
+	}{
+		{"no loss",
+			func(header) bool { return false },
+			func(s ReceiveStats) bool { return s.Multicast > 0 }},
+		{"one chunk per group lost",
+			func(h header) bool { i, ok := dataIndex(h); return ok && i%groupSize == 3 },
+			func(s ReceiveStats) bool { return s.Recovered > 0 }},
+		{"two chunks per group lost",
+			func(h header) bool { i, ok := dataIndex(h); return ok && i%groupSize >= 6 },
+			func(s ReceiveStats) bool { return s.Fallback > 0 && s.Multicast > 0 }},
+		{"everything lost",
+			func(header) bool { return true },
+			func(s ReceiveStats) bool { return s.Fallback == uint64(len(img)) }},
+	}
+
+	var addrs []net.Addr
+	var drops []func(header) bool
+	var receivers []*Receiver
+	for _, c := range cases {
+		conn := listen(t)
+		fallback, e := imgsrc.New(srv.URL, imgsrc.Options{})
+		if e != nil {
+			t.Fatal(e)
+		}
+		addrs = append(addrs, conn.LocalAddr())
+		drops = append(drops, c.drop)
+		r := NewReceiver(conn, fallback.(imgsrc.RandomAccessSource), uint64(len(img)),
+			ReceiveOptions{StreamID: 7, Timeout: 200 * time.Millisecond})
+		defer r.Close()
+		receivers = append(receivers, r)
+	}
+	relayConn := listen(t)
+	defer relayConn.Close()
+	go relay(relayConn, addrs, drops)
+
+	sendConn := listen(t)
+	defer sendConn.Close()
+	// A packet of another stream, which must be ignored.
+	Send(sendConn, relayConn.LocalAddr(), bytes.NewReader([]byte("other")), 5, SendOptions{StreamID: 8})
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- Send(sendConn, relayConn.LocalAddr(), bytes.NewReader(img), uint64(len(img)),
+			SendOptions{StreamID: 7, ChunkSize: chunkSize, GroupSize: groupSize, Rate: 4 * 1024 * 1024})
+	}()
+
+	for i, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			r := receivers[i]
+			act, e := ioutil.ReadAll(r)
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+			if !bytes.Equal(act, img) {
+				t.Errorf("received image differs")
+			}
+			s := r.Stats()
+			if s.Multicast+s.Recovered+s.Fallback != uint64(len(img)) {
+				t.Errorf("stats %+v don't add up to %v bytes", s, len(img))
+			}
+			if !c.check(s) {
+				t.Errorf("unexpected stats %+v", s)
+			}
+		})
+	}
+	if e := <-sendErr; e != nil {
+		t.Errorf("send failed: %v", e)
+	}
+}
+
+func TestReceiveNoFEC(t *testing.T) {
+	img := bytes.Repeat([]byte("0123456789"), 1000)
+	conn := listen(t)
+	// Chunk 2 is never sent, so it is read from the fallback.
+	sendConn := dropConn{listen(t), func(h header) bool { return h.index == 2 }}
+	defer sendConn.Close()
+	r := NewReceiver(conn, bytes.NewReader(img), uint64(len(img)), ReceiveOptions{})
+	defer r.Close()
+	go Send(sendConn, conn.LocalAddr(), bytes.NewReader(img), uint64(len(img)), SendOptions{ChunkSize: 1000})
+
+	act, e := ioutil.ReadAll(r)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !bytes.Equal(act, img) {
+		t.Errorf("received image differs")
+	}
+	if s := r.Stats(); s.Fallback != 1000 || s.Recovered != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// dropConn doesn't send packets for which drop returns true.
+type dropConn struct {
+	net.PacketConn
+	drop func(header) bool
+}
+
+func (c dropConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if h, _ := parseHeader(p); c.drop(h) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestReceiverDropsChunks(t *testing.T) {
+	img := make([]byte, 3000)
+	for i := range img {
+		img[i] = byte(i)
+	}
+	r := &Receiver{
+		fallback: bytes.NewReader(img),
+		size:     uint64(len(img)),
+		format:   header{size: uint64(len(img)), chunk: 100, group: 4},
+		chunks:   make(map[uint64][]byte),
+		parity:   make(map[uint64][]byte),
+	}
+	for i := uint64(0); i < 20; i++ {
+		if i < 11 || i > 14 {
+			r.chunks[i] = img[i*100 : (i+1)*100]
+		}
+	}
+	for g := uint64(0); g < 5; g++ {
+		r.parity[g] = make([]byte, 100)
+	}
+
+	// Chunks of the group containing next are kept for recovery.
+	r.advance(1050)
+	for i := range r.chunks {
+		if i < 8 {
+			t.Errorf("chunk %v was not dropped", i)
+		}
+	}
+	if len(r.chunks) != 8 {
+		t.Errorf("got %v chunks, want 8", len(r.chunks))
+	}
+	if _, ok := r.parity[1]; ok || len(r.parity) != 3 {
+		t.Errorf("got %v parity chunks, want groups 2 to 4", len(r.parity))
+	}
+
+	// The fallback is read up to the next chunk which was received.
+	if e := r.readFallback(); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !bytes.Equal(r.cur, img[1050:1500]) || r.next != 1500 {
+		t.Errorf("got %v bytes from the fallback and next %v, want 450 and 1500", len(r.cur), r.next)
+	}
+	if _, ok := r.chunks[10]; ok {
+		t.Errorf("chunk 10 was not dropped after the fallback read")
+	}
+}
@@ -0,0 +1,96 @@
+// Package mcast distributes an image file to many agents at once over UDP multicast.
+//
+// The sender transmits the file once, in order, as numbered chunks. After every
+// group of data chunks it sends a parity chunk (the XOR of the group), so that
+// receivers can recover one lost chunk per group. Receivers download chunks
+// which they can't recover from a fallback source (usually HTTP Range requests).
+package mcast
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+var magic = [4]byte{'S', 'M', 'M', 'C'}
+
+const (
+	kindData   = 0
+	kindParity = 1
+)
+
+// headerLen is the size of the header in front of each chunk.
+const headerLen = 35
+
+// header is the start of every packet (big endian):
+//
+//	magic  [4]byte
+//	stream uint64  // identifies the image stream
+//	size   uint64  // size of the image file
+//	chunk  uint32  // size of full data chunks
+//	group  uint16  // data chunks per parity chunk, 0 if there are none
+//	kind   uint8   // kindData or kindParity
+//	index  uint64  // chunk index for data, group index for parity
+type header struct {
+	stream uint64
+	size   uint64
+	chunk  uint32
+	group  uint16
+	kind   uint8
+	index  uint64
+}
+
+func (h header) put(b []byte) {
+	copy(b, magic[:])
+	binary.BigEndian.PutUint64(b[4:], h.stream)
+	binary.BigEndian.PutUint64(b[12:], h.size)
+	binary.BigEndian.PutUint32(b[20:], h.chunk)
+	binary.BigEndian.PutUint16(b[24:], h.group)
+	b[26] = h.kind
+	binary.BigEndian.PutUint64(b[27:], h.index)
+}
+
+// parseHeader returns the header of a packet, and false if b is not a valid packet.
+func parseHeader(b []byte) (header, bool) {
+	var h header
+	if len(b) < headerLen || string(b[:4]) != string(magic[:]) {
+		return h, false
+	}
+	h.stream = binary.BigEndian.Uint64(b[4:])
+	h.size = binary.BigEndian.Uint64(b[12:])
+	h.chunk = binary.BigEndian.Uint32(b[20:])
+	h.group = binary.BigEndian.Uint16(b[24:])
+	h.kind = b[26]
+	h.index = binary.BigEndian.Uint64(b[27:])
+	if h.chunk == 0 || (h.kind != kindData && h.kind != kindParity) {
+		return h, false
+	}
+	return h, true
+}
+
+// chunkLen returns the length of data chunk i of the image.
+func (h header) chunkLen(i uint64) uint64 {
+	start := i * uint64(h.chunk)
+	if start >= h.size {
+		return 0
+	}
+	if l := h.size - start; l < uint64(h.chunk) {
+		return l
+	}
+	return uint64(h.chunk)
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i, v := range src {
+		dst[i] ^= v
+	}
+}
+
+// Join joins a multicast group ("address:port") on all interfaces
+// and returns a connection for receiving from it.
+func Join(group string) (net.PacketConn, error) {
+	addr, e := net.ResolveUDPAddr("udp", group)
+	if e != nil {
+		return nil, e
+	}
+	return net.ListenMulticastUDP("udp", nil, addr)
+}
@@ -0,0 +1,332 @@
+package mcast
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReceiveOptions configures a Receiver.
+type ReceiveOptions struct {
+	StreamID uint64
+	// Timeout is how long Read waits for missing chunks before using the
+	// fallback source (2s if 0). After a timeout, Read only waits again
+	// once new packets arrive.
+	Timeout time.Duration
+	// Window limits how far ahead of the reader chunks are buffered (64 MiB if 0).
+	Window uint64
+}
+
+const (
+	defaultTimeout = 2 * time.Second
+	defaultWindow  = 64 * 1024 * 1024
+
+	// fallbackSize is the maximum number of bytes read from the fallback source at once.
+	fallbackSize = 4 * 1024 * 1024
+)
+
+// ReceiveStats counts where the bytes returned by a Receiver came from.
+type ReceiveStats struct {
+	Multicast uint64 // received in data chunks
+	Recovered uint64 // reconstructed from parity chunks
+	Fallback  uint64 // read from the fallback source
+}
+
+// Receiver reads an image which is sent with Send. It returns the image
+// in order, like a plain download. Chunks which were lost are recovered with
+// parity chunks if possible, and otherwise read from the fallback source.
+type Receiver struct {
+	conn     net.PacketConn
+	fallback io.ReaderAt
+	size     uint64
+	opts     ReceiveOptions
+	notify   chan struct{} // signalled when a packet was added
+
+	mu            sync.Mutex
+	format        header            // chunk and group size of the stream, chunk is 0 until the first packet
+	chunks        map[uint64][]byte // data chunks, by index
+	parity        map[uint64][]byte // parity chunks, by group index
+	maxSeen       uint64            // one more than the highest chunk index seen in any packet
+	next          uint64            // offset of the first byte which Read did not return yet
+	dropped       uint64            // chunks before this index were dropped
+	droppedGroups uint64            // parity chunks of groups before this index were dropped
+	idle          bool              // whether Read timed out and no packet arrived since
+
+	cur   []byte // rest of the data at next-len(cur), only used by Read
+	stats ReceiveStats
+}
+
+// NewReceiver starts receiving an image of the given size from conn.
+// Closing the Receiver closes conn.
+func NewReceiver(conn net.PacketConn, fallback io.ReaderAt, size uint64, opts ReceiveOptions) *Receiver {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Window == 0 {
+		opts.Window = defaultWindow
+	}
+	if u, ok := conn.(*net.UDPConn); ok {
+		// Best effort, the kernel may limit the size.
+		u.SetReadBuffer(4 * 1024 * 1024)
+	}
+	r := &Receiver{
+		conn:     conn,
+		fallback: fallback,
+		size:     size,
+		opts:     opts,
+		notify:   make(chan struct{}, 1),
+		chunks:   make(map[uint64][]byte),
+		parity:   make(map[uint64][]byte),
+	}
+	go r.receive()
+	return r
+}
+
+func (r *Receiver) receive() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, e := r.conn.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		h, ok := parseHeader(buf[:n])
+		if !ok || h.stream != r.opts.StreamID || h.size != r.size {
+			continue
+		}
+		r.mu.Lock()
+		added := r.add(h, buf[headerLen:n])
+		r.mu.Unlock()
+		if added {
+			select {
+			case r.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// add stores a packet, unless it is not needed. r.mu must be held.
+func (r *Receiver) add(h header, payload []byte) bool {
+	if r.format.chunk == 0 {
+		r.format = h
+	}
+	if h.chunk != r.format.chunk || h.group != r.format.group {
+		return false
+	}
+	cs := uint64(h.chunk)
+	last := h.index // index of the last data chunk covered by the packet
+	if h.kind == kindParity {
+		if h.group == 0 {
+			return false
+		}
+		last = (h.index+1)*uint64(h.group) - 1
+	}
+	if last+1 > r.maxSeen {
+		r.maxSeen = last + 1
+	}
+	r.idle = false
+	if (last+1)*cs <= r.retainFrom() || last*cs >= r.next+r.opts.Window {
+		return true
+	}
+
+	p := make([]byte, len(payload))
+	copy(p, payload)
+	if h.kind == kindParity {
+		if uint64(len(p)) == cs {
+			r.parity[h.index] = p
+		}
+	} else if uint64(len(p)) == h.chunkLen(h.index) {
+		r.chunks[h.index] = p
+	}
+	return true
+}
+
+// retainFrom returns the offset from which chunks must be kept.
+// Chunks before next are kept if they are needed to recover the current group.
+func (r *Receiver) retainFrom() uint64 {
+	if r.format.chunk == 0 || r.format.group == 0 {
+		return r.next
+	}
+	g := uint64(r.format.group) * uint64(r.format.chunk)
+	return r.next / g * g
+}
+
+func (r *Receiver) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		r.mu.Lock()
+		done := r.next >= r.size
+		r.mu.Unlock()
+		if done {
+			return 0, io.EOF
+		}
+		if e := r.fill(); e != nil {
+			return 0, e
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// fill sets cur to the data at next and advances next.
+func (r *Receiver) fill() error {
+	for {
+		r.mu.Lock()
+		ok := r.take()
+		lost := !ok && (r.idle || r.isLost())
+		if !ok && !lost {
+			// Clear a stale notification, so that waiting
+			// below only ends for packets added from now on.
+			select {
+			case <-r.notify:
+				r.mu.Unlock()
+				continue
+			default:
+			}
+		}
+		r.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if lost {
+			return r.readFallback()
+		}
+
+		select {
+		case <-r.notify:
+		case <-time.After(r.opts.Timeout):
+			r.mu.Lock()
+			r.idle = true
+			r.mu.Unlock()
+		}
+	}
+}
+
+// take sets cur to the chunk containing next, if it was received or can be
+// recovered. r.mu must be held.
+func (r *Receiver) take() bool {
+	cs := uint64(r.format.chunk)
+	if cs == 0 {
+		return false
+	}
+	i := r.next / cs
+	c, ok := r.chunks[i]
+	if !ok {
+		if c, ok = r.recover(i); !ok {
+			return false
+		}
+		r.stats.Recovered += uint64(len(c)) - (r.next - i*cs)
+	} else {
+		r.stats.Multicast += uint64(len(c)) - (r.next - i*cs)
+	}
+	r.cur = c[r.next-i*cs:]
+	r.advance(i*cs + uint64(len(c)))
+	return true
+}
+
+// recover reconstructs data chunk i from the other chunks of its group
+// and the parity chunk. r.mu must be held.
+func (r *Receiver) recover(i uint64) ([]byte, bool) {
+	gs := uint64(r.format.group)
+	if gs == 0 {
+		return nil, false
+	}
+	p, ok := r.parity[i/gs]
+	if !ok {
+		return nil, false
+	}
+	c := make([]byte, len(p))
+	copy(c, p)
+	for j := i / gs * gs; j < (i/gs+1)*gs && r.format.chunkLen(j) > 0; j++ {
+		if j == i {
+			continue
+		}
+		o, ok := r.chunks[j]
+		if !ok {
+			return nil, false
+		}
+		xorInto(c, o)
+	}
+	return c[:r.format.chunkLen(i)], true
+}
+
+// isLost reports whether the chunk at next can't arrive anymore, since
+// the sender already sent later packets. r.mu must be held.
+func (r *Receiver) isLost() bool {
+	cs := uint64(r.format.chunk)
+	if cs == 0 {
+		return false
+	}
+	i := r.next / cs
+	if gs := uint64(r.format.group); gs > 0 {
+		// The parity chunk of the group is sent after its last data chunk.
+		return r.maxSeen > (i/gs+1)*gs
+	}
+	return r.maxSeen > i+1
+}
+
+// readFallback sets cur to data from the fallback source, up to the next
+// chunk which was received.
+func (r *Receiver) readFallback() error {
+	r.mu.Lock()
+	start := r.next
+	end := start + fallbackSize
+	if end > r.size {
+		end = r.size
+	}
+	if cs := uint64(r.format.chunk); cs > 0 {
+		for i := start/cs + 1; i*cs < end; i++ {
+			if _, ok := r.chunks[i]; ok {
+				end = i * cs
+				break
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	buf := make([]byte, end-start)
+	if n, e := r.fallback.ReadAt(buf, int64(start)); n < len(buf) {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return e
+	}
+	r.mu.Lock()
+	r.advance(end)
+	r.mu.Unlock()
+	r.cur = buf
+	r.stats.Fallback += uint64(len(buf))
+	return nil
+}
+
+// advance sets next and drops chunks which are not needed anymore. r.mu must be held.
+func (r *Receiver) advance(next uint64) {
+	r.next = next
+	cs := uint64(r.format.chunk)
+	if cs == 0 {
+		return
+	}
+	// add does not store chunks before from, so only the indexes
+	// between the previous and the new from have to be deleted.
+	from := r.retainFrom()
+	for ; r.dropped < from/cs; r.dropped++ {
+		delete(r.chunks, r.dropped)
+	}
+	if gs := uint64(r.format.group); gs > 0 {
+		for ; r.droppedGroups < from/(gs*cs); r.droppedGroups++ {
+			delete(r.parity, r.droppedGroups)
+		}
+	}
+}
+
+// Stats returns where the data returned so far came from.
+// It must not be called concurrently with Read.
+func (r *Receiver) Stats() ReceiveStats {
+	return r.stats
+}
+
+// Close stops receiving and closes the connection.
+func (r *Receiver) Close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,85 @@
+package mcast
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SendOptions configures Send.
+type SendOptions struct {
+	StreamID  uint64
+	ChunkSize int   // bytes of image data per packet, 1400 if 0
+	GroupSize int   // data chunks per parity chunk, no parity chunks if 0
+	Rate      int64 // bytes per second, unlimited if 0
+}
+
+const defaultChunkSize = 1400
+
+// Send transmits size bytes of img once to dst.
+func Send(conn net.PacketConn, dst net.Addr, img io.ReaderAt, size uint64, opts SendOptions) error {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.ChunkSize < 0 || opts.GroupSize < 0 || opts.GroupSize > 0xFFFF {
+		return fmt.Errorf("invalid chunk size %v or group size %v", opts.ChunkSize, opts.GroupSize)
+	}
+	h := header{
+		stream: opts.StreamID,
+		size:   size,
+		chunk:  uint32(opts.ChunkSize),
+		group:  uint16(opts.GroupSize),
+	}
+	buf := make([]byte, headerLen+opts.ChunkSize)
+	parity := make([]byte, headerLen+opts.ChunkSize)
+	start := time.Now()
+	var sent int64
+	send := func(p []byte) error {
+		if _, e := conn.WriteTo(p, dst); e != nil {
+			return e
+		}
+		sent += int64(len(p))
+		if opts.Rate > 0 {
+			want := time.Duration(sent * int64(time.Second) / opts.Rate)
+			if d := want - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		return nil
+	}
+
+	chunks := (size + uint64(h.chunk) - 1) / uint64(h.chunk)
+	for i := uint64(0); i < chunks; i++ {
+		data := buf[headerLen : headerLen+h.chunkLen(i)]
+		if n, e := img.ReadAt(data, int64(i*uint64(h.chunk))); n < len(data) {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return e
+		}
+		h.kind = kindData
+		h.index = i
+		h.put(buf)
+		if e := send(buf[:headerLen+len(data)]); e != nil {
+			return e
+		}
+
+		if h.group == 0 {
+			continue
+		}
+		xorInto(parity[headerLen:], data)
+		if i%uint64(h.group) == uint64(h.group)-1 || i == chunks-1 {
+			h.kind = kindParity
+			h.index = i / uint64(h.group)
+			h.put(parity)
+			if e := send(parity); e != nil {
+				return e
+			}
+			for j := range parity {
+				parity[j] = 0
+			}
+		}
+	}
+	return nil
+}
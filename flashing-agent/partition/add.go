@@ -20,9 +20,9 @@ func Add(table *gpt.Table, p *gpt.Partition) error {
 	return errors.New("Can't add partition. No space left in partition table.")
 }
 
-func AddFindSpace(table *gpt.Table, p *gpt.Partition, side DiskSide) error {
+func AddFindSpace(table *gpt.Table, p *gpt.Partition, side DiskSide, align uint64) error {
 	blocks := p.LastLBA - p.FirstLBA + 1
-	firstLBA, lastLBA, found := FindSpace(table, blocks, side)
+	firstLBA, lastLBA, found := FindSpace(table, blocks, side, align)
 	if !found {
 		return fmt.Errorf("Could not find %v blocks for partition %v",
 			blocks, p.Id.String())
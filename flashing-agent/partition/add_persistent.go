@@ -30,12 +30,15 @@ func convertPartition(p *pb.FlashingConfig_Partition) (*gpt.Partition, error) {
 	diskP := gpt.Partition{
 		Id:   id,
 		Type: gptType,
-		// TODO part name and other fields
 	}
+	if e := SetName(&diskP, p.Name); e != nil {
+		return nil, e
+	}
+	SetAttributes(&diskP, p.Attributes)
 	return &diskP, nil
 }
 
-func AddPersistentIfMissing(table *gpt.Table, p *pb.FlashingConfig_Partition) error {
+func AddPersistentIfMissing(table *gpt.Table, p *pb.FlashingConfig_Partition, align uint64) error {
 	if !ContainsId(table.Partitions, &p.PartUuid) {
 		size := partitionSectorSize(p, table.SectorSize)
 		diskP, e := convertPartition(p)
@@ -44,7 +47,7 @@ func AddPersistentIfMissing(table *gpt.Table, p *pb.FlashingConfig_Partition) er
 		}
 		diskP.FirstLBA = 0
 		diskP.LastLBA = size - 1
-		if e := AddFindSpace(table, diskP, End); e != nil {
+		if e := AddFindSpace(table, diskP, End, align); e != nil {
 			return e
 		}
 	}
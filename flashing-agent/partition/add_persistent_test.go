@@ -186,7 +186,7 @@ func TestAddPersistent(t *testing.T) {
 		}, false, ""},
 	}
 	for i, c := range cases {
-		e := AddPersistentIfMissing(&c.table, &c.toAdd)
+		e := AddPersistentIfMissing(&c.table, &c.toAdd, 1)
 
 		if c.shouldFail {
 			if e == nil {
@@ -214,3 +214,39 @@ func TestAddPersistent(t *testing.T) {
 		}
 	}
 }
+
+func TestAddPersistentNameAndAttributes(t *testing.T) {
+	table := gpt.Table{
+		SectorSize: 512,
+		Header:     gpt.Header{FirstUsableLBA: 5, LastUsableLBA: 70},
+		Partitions: make([]gpt.Partition, 1),
+	}
+	toAdd := pb.FlashingConfig_Partition{
+		PartUuid:   testUuidStrings[3],
+		GptType:    testUuidStrings[1],
+		Size:       5120,
+		Name:       "var",
+		Attributes: 1<<63 | 1,
+	}
+	if e := AddPersistentIfMissing(&table, &toAdd, 1); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	p := &table.Partitions[0]
+	if Name(p) != "var" || Attributes(p) != 1<<63|1 {
+		t.Errorf("got name %q and attributes %#x, want %q and %#x",
+			Name(p), Attributes(p), toAdd.Name, toAdd.Attributes)
+	}
+	if e := AssertExistingPartitionsMatchExact(&table, []pb.FlashingConfig_Partition{toAdd}); e != nil {
+		t.Errorf("unexpected error for matching partition: %v", e)
+	}
+	toAdd.Name = "srv"
+	if e := AssertExistingPartitionsMatchExact(&table, []pb.FlashingConfig_Partition{toAdd}); e == nil {
+		t.Errorf("expected error for partition with other name")
+	}
+
+	toAdd.PartUuid = testUuidStrings[4]
+	toAdd.Name = strings.Repeat("x", 40)
+	if e := AddPersistentIfMissing(&table, &toAdd, 1); e == nil {
+		t.Errorf("expected error for long name")
+	}
+}
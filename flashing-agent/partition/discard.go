@@ -0,0 +1,90 @@
+package partition
+
+import (
+	"fmt"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+
+	"github.com/rekby/gpt"
+)
+
+// LBARange is a range of blocks, including FirstLBA and LastLBA.
+type LBARange struct {
+	FirstLBA uint64
+	LastLBA  uint64
+}
+
+// DiscardRanges returns the ranges of merged which don't hold data worth
+// keeping: free space, and partitions which are not in old at the same place
+// (newly created image partitions). Adjacent ranges are joined.
+// Ranges never overlap persistent partitions in old or merged.
+func DiscardRanges(old, merged *gpt.Table, persistent []pb.FlashingConfig_Partition) ([]LBARange, error) {
+	var out []LBARange
+	add := func(first, last uint64) {
+		if n := len(out); n > 0 && out[n-1].LastLBA+1 == first {
+			out[n-1].LastLBA = last
+		} else {
+			out = append(out, LBARange{first, last})
+		}
+	}
+	for _, r := range calculateDiskRanges(merged) {
+		if r.LastLBA < r.FirstLBA {
+			continue
+		}
+		if r.Partition == nil || !inPlace(old, r.Partition) && !isPersistent(r.Partition, persistent) {
+			add(r.FirstLBA, r.LastLBA)
+		}
+	}
+	for _, t := range []*gpt.Table{old, merged} {
+		for i := range t.Partitions {
+			p := &t.Partitions[i]
+			if p.IsEmpty() || !isPersistent(p, persistent) {
+				continue
+			}
+			for _, r := range out {
+				if r.FirstLBA <= p.LastLBA && p.FirstLBA <= r.LastLBA {
+					return nil, fmt.Errorf("Discard range %v-%v overlaps persistent partition %v.",
+						r.FirstLBA, r.LastLBA, p.Id.String())
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// Exclude returns ranges without the blocks from first to last.
+func Exclude(ranges []LBARange, first, last uint64) []LBARange {
+	var out []LBARange
+	for _, r := range ranges {
+		if r.LastLBA < first || last < r.FirstLBA {
+			out = append(out, r)
+			continue
+		}
+		if r.FirstLBA < first {
+			out = append(out, LBARange{r.FirstLBA, first - 1})
+		}
+		if last < r.LastLBA {
+			out = append(out, LBARange{last + 1, r.LastLBA})
+		}
+	}
+	return out
+}
+
+func inPlace(table *gpt.Table, p *gpt.Partition) bool {
+	for i := range table.Partitions {
+		o := &table.Partitions[i]
+		if !o.IsEmpty() && o.Id == p.Id && o.FirstLBA == p.FirstLBA && o.LastLBA == p.LastLBA {
+			return true
+		}
+	}
+	return false
+}
+
+func isPersistent(p *gpt.Partition, persistent []pb.FlashingConfig_Partition) bool {
+	for i := range persistent {
+		if MatchesId(p, &persistent[i].PartUuid) {
+			return true
+		}
+	}
+	return false
+}
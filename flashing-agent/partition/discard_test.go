@@ -0,0 +1,86 @@
+package partition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+
+	"github.com/rekby/gpt"
+)
+
+func TestDiscardRanges(t *testing.T) {
+	header := gpt.Header{FirstUsableLBA: 5, LastUsableLBA: 99}
+	old := gpt.Table{
+		SectorSize: 512,
+		Header:     header,
+		Partitions: []gpt.Partition{
+			{FirstLBA: 10, LastLBA: 19, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 20, LastLBA: 29, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 50, LastLBA: 59, Id: testUuids[3], Type: gpt.PartType(testUuids[3])},
+		},
+	}
+	merged := gpt.Table{
+		SectorSize: 512,
+		Header:     header,
+		Partitions: []gpt.Partition{
+			// Unchanged image partition.
+			{FirstLBA: 10, LastLBA: 19, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			// Moved image partition.
+			{FirstLBA: 30, LastLBA: 39, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+			// Persistent partition.
+			{FirstLBA: 50, LastLBA: 59, Id: testUuids[3], Type: gpt.PartType(testUuids[3])},
+			{},
+		},
+	}
+	pers := []pb.FlashingConfig_Partition{{PartUuid: testUuidStrings[3]}}
+
+	ranges, e := DiscardRanges(&old, &merged, pers)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	expected := []LBARange{{5, 9}, {20, 49}, {60, 99}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+
+	// A persistent partition which is not in the merged table must not be
+	// overwritten by a new partition, and can't be discarded either.
+	merged.Partitions[2] = gpt.Partition{}
+	if _, e := DiscardRanges(&old, &merged, pers); e == nil || !strings.Contains(e.Error(), "overlaps") {
+		t.Errorf("expected overlap error, got %v", e)
+	}
+
+	// New persistent partitions are not discarded.
+	merged.Partitions[3] = gpt.Partition{FirstLBA: 70, LastLBA: 79, Id: testUuids[4], Type: gpt.PartType(testUuids[3])}
+	pers = append(pers, pb.FlashingConfig_Partition{PartUuid: testUuidStrings[4]})
+	old.Partitions = old.Partitions[:2]
+	ranges, e = DiscardRanges(&old, &merged, pers)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	expected = []LBARange{{5, 9}, {20, 69}, {80, 99}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	ranges := []LBARange{{0, 9}, {20, 29}, {40, 49}}
+	var cases = []struct {
+		first, last uint64
+		expected    []LBARange
+	}{
+		{10, 19, ranges},
+		{0, 9, []LBARange{{20, 29}, {40, 49}}},
+		{5, 24, []LBARange{{0, 4}, {25, 29}, {40, 49}}},
+		{22, 23, []LBARange{{0, 9}, {20, 21}, {24, 29}, {40, 49}}},
+		{0, 100, nil},
+	}
+	for i, c := range cases {
+		if out := Exclude(ranges, c.first, c.last); !reflect.DeepEqual(out, c.expected) {
+			t.Errorf("Test case %v: expected %v, got %v", i, c.expected, out)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package partition
+
+import "github.com/rekby/gpt"
+
+// FindContaining returns the non-empty partition which contains the given LBA,
+// or nil if there is none.
+func FindContaining(table *gpt.Table, lba uint64) *gpt.Partition {
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		if !p.IsEmpty() && p.FirstLBA <= lba && lba <= p.LastLBA {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package partition
+
+import (
+	"testing"
+
+	"github.com/rekby/gpt"
+)
+
+func TestFindContaining(t *testing.T) {
+	table := gpt.Table{
+		SectorSize: 512,
+		Partitions: []gpt.Partition{
+			{FirstLBA: 10, LastLBA: 20,
+				Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 30, LastLBA: 30,
+				Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 40, LastLBA: 50,
+				Id: testUuids[3], Type: gpt.PartType(testUuids[0])},
+		},
+	}
+	cases := []struct {
+		lba    uint64
+		expIdx int // -1 if no partition should be found
+	}{
+		{0, -1},
+		{9, -1},
+		{10, 0},
+		{15, 0},
+		{20, 0},
+		{21, -1},
+		{30, 1},
+		{45, -1}, // empty partition
+	}
+	for i, c := range cases {
+		act := FindContaining(&table, c.lba)
+		if c.expIdx == -1 {
+			if act != nil {
+				t.Errorf("Test case %v: Expected no partition, but got %v", i, act.Id.String())
+			}
+		} else if act != &table.Partitions[c.expIdx] {
+			t.Errorf("Test case %v: Expected partition %v, but got %v", i, c.expIdx, act)
+		}
+	}
+}
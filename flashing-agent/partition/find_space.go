@@ -19,27 +19,45 @@ type diskRange struct {
 	Partition *gpt.Partition
 }
 
-func (r *diskRange) enoughBlocksFree(blocks uint64) bool {
-	return r.Partition == nil && (r.LastLBA-r.FirstLBA+1) >= blocks
+// place returns the aligned position of blocks in the range, if the range is free and large enough.
+func (r *diskRange) place(blocks uint64, side DiskSide, align uint64) (firstLBA, lastLBA uint64, found bool) {
+	if r.Partition != nil || r.LastLBA < r.FirstLBA || r.LastLBA-r.FirstLBA+1 < blocks {
+		return 0, 0, false
+	}
+	if side == Start {
+		firstLBA = (r.FirstLBA + align - 1) / align * align
+	} else {
+		firstLBA = (r.LastLBA - blocks + 1) / align * align
+	}
+	if firstLBA < r.FirstLBA || firstLBA+blocks-1 > r.LastLBA {
+		return 0, 0, false
+	}
+	return firstLBA, firstLBA + blocks - 1, true
 }
 
+// FindSpace returns the first (or last) free range of the given number of
+// blocks which starts at a multiple of align blocks (0 for no alignment).
 func FindSpace(
-	table *gpt.Table, blocks uint64, side DiskSide,
+	table *gpt.Table, blocks uint64, side DiskSide, align uint64,
 ) (firstLBA, lastLBA uint64, found bool) {
 	if blocks == 0 {
 		return 0, 0, false
 	}
+	if align == 0 {
+		align = 1
+	}
 	diskRanges := calculateDiskRanges(table)
 	if side == Start {
 		for _, r := range diskRanges {
-			if r.enoughBlocksFree(blocks) {
-				return r.FirstLBA, r.FirstLBA + blocks - 1, true
+			if first, last, ok := r.place(blocks, side, align); ok {
+				return first, last, true
 			}
 		}
 	} else {
 		for i, _ := range diskRanges {
-			if r := diskRanges[len(diskRanges)-1-i]; r.enoughBlocksFree(blocks) {
-				return r.LastLBA - blocks + 1, r.LastLBA, true
+			r := diskRanges[len(diskRanges)-1-i]
+			if first, last, ok := r.place(blocks, side, align); ok {
+				return first, last, true
 			}
 		}
 	}
@@ -165,7 +165,7 @@ func TestFindSpace(t *testing.T) {
 		}, 1, End, 5, 5, true},
 	}
 	for i, c := range cases {
-		firstLBA, lastLBA, found := FindSpace(&c.table, c.blocks, c.side)
+		firstLBA, lastLBA, found := FindSpace(&c.table, c.blocks, c.side, 1)
 		if firstLBA != c.expectedFirstLBA {
 			t.Errorf("Test case %v: Wrong FirstLBA - expected/actual: %v/%v",
 				i, c.expectedFirstLBA, firstLBA)
@@ -180,3 +180,34 @@ func TestFindSpace(t *testing.T) {
 		}
 	}
 }
+
+func TestFindSpaceAligned(t *testing.T) {
+	table := gpt.Table{
+		Header: gpt.Header{FirstUsableLBA: 5, LastUsableLBA: 30},
+		Partitions: []gpt.Partition{
+			{FirstLBA: 8, LastLBA: 9, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 22, LastLBA: 25, Id: testUuids[2], Type: gpt.PartType(testUuids[1])},
+		},
+	}
+	var cases = []struct {
+		blocks           uint64
+		side             DiskSide
+		expectedFirstLBA uint64
+		expectedLastLBA  uint64
+		expectedFound    bool
+	}{
+		{2, Start, 12, 13, true}, // 5-7 is free, but does not contain an aligned range
+		{8, Start, 12, 19, true}, // 10-21 is free
+		{11, Start, 0, 0, false}, // 10-21 only contains 10 blocks from an aligned start
+		{3, End, 28, 30, true},   // 26-30 is free
+		{4, End, 16, 19, true},   // 28-31 does not fit
+		{1, End, 28, 28, true},   // the last aligned block
+	}
+	for i, c := range cases {
+		firstLBA, lastLBA, found := FindSpace(&table, c.blocks, c.side, 4)
+		if firstLBA != c.expectedFirstLBA || lastLBA != c.expectedLastLBA || found != c.expectedFound {
+			t.Errorf("Test case %v: got %v-%v (found: %v), want %v-%v (found: %v)", i,
+				firstLBA, lastLBA, found, c.expectedFirstLBA, c.expectedLastLBA, c.expectedFound)
+		}
+	}
+}
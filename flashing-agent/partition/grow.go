@@ -0,0 +1,77 @@
+package partition
+
+import (
+	"fmt"
+
+	"github.com/rekby/gpt"
+)
+
+// Grow extends the partition with the given id into the free space which
+// follows it. Partitions in movable which follow it (with only free space
+// in between) are moved to the end of that space, in the same order and
+// starting at multiples of align blocks.
+// It returns the number of blocks which were added to the partition.
+func Grow(table *gpt.Table, id gpt.Guid, movable []gpt.Guid, align uint64) (uint64, error) {
+	if align == 0 {
+		align = 1
+	}
+	var target *gpt.Partition
+	for i := range table.Partitions {
+		if p := &table.Partitions[i]; !p.IsEmpty() && EqGUID(p.Id, id) {
+			target = p
+		}
+	}
+	if target == nil {
+		return 0, fmt.Errorf("partition %v to grow not found", id.String())
+	}
+
+	// Find the movable partitions after the target and the end of the space they share.
+	var following []*gpt.Partition
+	end := target.LastLBA
+	for _, r := range calculateDiskRanges(table) {
+		if r.FirstLBA != end+1 || r.LastLBA < r.FirstLBA {
+			continue
+		}
+		if r.Partition != nil && !containsGUID(movable, r.Partition.Id) {
+			break
+		}
+		if r.Partition != nil {
+			following = append(following, r.Partition)
+		}
+		end = r.LastLBA
+	}
+
+	type position struct{ first, last uint64 }
+	moved := make([]position, len(following))
+	for i := len(following) - 1; i >= 0; i-- {
+		p := following[i]
+		blocks := p.LastLBA - p.FirstLBA + 1
+		if end+1 < blocks {
+			return 0, nil
+		}
+		first := (end - blocks + 1) / align * align
+		moved[i] = position{first, first + blocks - 1}
+		if first == 0 {
+			return 0, nil
+		}
+		end = first - 1
+	}
+	if end <= target.LastLBA {
+		return 0, nil
+	}
+	for i, p := range following {
+		p.FirstLBA, p.LastLBA = moved[i].first, moved[i].last
+	}
+	grown := end - target.LastLBA
+	target.LastLBA = end
+	return grown, nil
+}
+
+func containsGUID(ids []gpt.Guid, id gpt.Guid) bool {
+	for _, v := range ids {
+		if EqGUID(v, id) {
+			return true
+		}
+	}
+	return false
+}
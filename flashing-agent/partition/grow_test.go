@@ -0,0 +1,104 @@
+package partition
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rekby/gpt"
+)
+
+func TestGrow(t *testing.T) {
+	header := gpt.Header{FirstUsableLBA: 5, LastUsableLBA: 100}
+	var cases = []struct {
+		label         string
+		partitions    []gpt.Partition
+		movable       []gpt.Guid
+		expGrown      uint64
+		remaining     []gpt.Partition
+		shouldContain string
+	}{
+		{"grow to end of disk", []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+		}, nil, 90, []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 100, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+		}, ""},
+		{"grow up to fixed partition", []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 90, LastLBA: 100, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		}, nil, 79, []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 89, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 90, LastLBA: 100, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		}, ""},
+		{"move following partitions", []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 13, LastLBA: 20, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 11, LastLBA: 12, Id: testUuids[3], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 95, LastLBA: 100, Id: testUuids[4], Type: gpt.PartType(testUuids[3])},
+		}, []gpt.Guid{testUuids[2], testUuids[3]}, 74, []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 84, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 87, LastLBA: 94, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 85, LastLBA: 86, Id: testUuids[3], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 95, LastLBA: 100, Id: testUuids[4], Type: gpt.PartType(testUuids[3])},
+		}, ""},
+		{"blocked by fixed partition", []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 11, LastLBA: 20, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		}, nil, 0, []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 11, LastLBA: 20, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		}, ""},
+		{"missing partition", []gpt.Partition{
+			{FirstLBA: 5, LastLBA: 10, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		}, nil, 0, nil, "not found"},
+	}
+	for _, c := range cases {
+		table := gpt.Table{Header: header, Partitions: c.partitions}
+		grown, e := Grow(&table, testUuids[1], c.movable, 1)
+		if c.shouldContain != "" {
+			if e == nil || !strings.Contains(e.Error(), c.shouldContain) {
+				t.Errorf("%v: got error %v, want error containing %q", c.label, e, c.shouldContain)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%v: unexpected error: %v", c.label, e)
+			continue
+		}
+		if grown != c.expGrown {
+			t.Errorf("%v: grew by %v blocks, want %v", c.label, grown, c.expGrown)
+		}
+		for j, p := range table.Partitions {
+			if exp := c.remaining[j]; !matchesEnough(&exp, &p) {
+				t.Errorf("%v: partition %v is %+v, want %+v", c.label, j, p, exp)
+			}
+		}
+	}
+}
+
+func TestGrowAligned(t *testing.T) {
+	table := gpt.Table{
+		Header: gpt.Header{FirstUsableLBA: 4, LastUsableLBA: 100},
+		Partitions: []gpt.Partition{
+			{FirstLBA: 4, LastLBA: 10, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+			{FirstLBA: 12, LastLBA: 13, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+		},
+	}
+	// The gap before the moved partition is used as well,
+	// and the moved partition keeps its alignment.
+	grown, e := Grow(&table, testUuids[1], []gpt.Guid{testUuids[2]}, 4)
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	exp := []gpt.Partition{
+		{FirstLBA: 4, LastLBA: 95, Id: testUuids[1], Type: gpt.PartType(testUuids[3])},
+		{FirstLBA: 96, LastLBA: 97, Id: testUuids[2], Type: gpt.PartType(testUuids[3])},
+	}
+	if grown != 85 {
+		t.Errorf("grew by %v blocks, want 85", grown)
+	}
+	for j, p := range table.Partitions {
+		if !matchesEnough(&exp[j], &p) {
+			t.Errorf("partition %v is %+v, want %+v", j, p, exp[j])
+		}
+	}
+}
@@ -17,7 +17,9 @@ func Matches(
 ) bool {
 	return strings.ToLower(real.Id.String()) == strings.ToLower(search.PartUuid) &&
 		strings.ToLower(real.Type.String()) == strings.ToLower(search.GptType) &&
-		sizeBytes(real, sectorSize) == search.Size
+		sizeBytes(real, sectorSize) == search.Size &&
+		Name(real) == search.Name &&
+		Attributes(real) == search.Attributes
 }
 
 func MatchesId(
@@ -38,6 +40,13 @@ func ContainsId(
 	return false
 }
 
+// MatchesGrow checks if a partition matches the unique GUID or the type
+// of a grow rule. Empty fields of the rule match nothing.
+func MatchesGrow(real *gpt.Partition, g *pb.FlashingConfig_GrowPartition) bool {
+	return (g.PartUuid != "" && MatchesId(real, &g.PartUuid)) ||
+		(g.GptType != "" && strings.ToLower(real.Type.String()) == strings.ToLower(g.GptType))
+}
+
 // EqGUID checks if two GPT GUIDs are equal.
 func EqGUID(a gpt.Guid, b gpt.Guid) bool {
 	for i := range a {
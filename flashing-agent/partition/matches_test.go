@@ -126,3 +126,29 @@ func TestContainsId(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchesNameAndAttributes(t *testing.T) {
+	real := gpt.Partition{Id: testUuids[1], Type: gpt.PartType(testUuids[2]), FirstLBA: 30, LastLBA: 30}
+	SetName(&real, "root")
+	SetAttributes(&real, 1<<63)
+	search := pb.FlashingConfig_Partition{
+		PartUuid:   testUuidStrings[1],
+		GptType:    testUuidStrings[2],
+		Size:       512,
+		Name:       "root",
+		Attributes: 1 << 63,
+	}
+	if !Matches(&real, &search, 512) {
+		t.Errorf("Expected partition to match")
+	}
+	wrongName := search
+	wrongName.Name = "home"
+	if Matches(&real, &wrongName, 512) {
+		t.Errorf("Expected partition with other name not to match")
+	}
+	wrongAttributes := search
+	wrongAttributes.Attributes = 0
+	if Matches(&real, &wrongAttributes, 512) {
+		t.Errorf("Expected partition with other attributes not to match")
+	}
+}
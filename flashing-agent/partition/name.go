@@ -0,0 +1,48 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/rekby/gpt"
+)
+
+// Name returns the partition name, which is stored as
+// little endian UTF-16 and terminated by 0 if it is shorter than 36 units.
+func Name(p *gpt.Partition) string {
+	var units []uint16
+	for i := 0; i+1 < len(p.PartNameUTF16); i += 2 {
+		u := binary.LittleEndian.Uint16(p.PartNameUTF16[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// SetName sets the partition name. It fails if the name is too long.
+func SetName(p *gpt.Partition, name string) error {
+	units := utf16.Encode([]rune(name))
+	if 2*len(units) > len(p.PartNameUTF16) {
+		return fmt.Errorf("Partition name %q is longer than %v UTF-16 units.",
+			name, len(p.PartNameUTF16)/2)
+	}
+	var encoded [72]byte
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], u)
+	}
+	p.PartNameUTF16 = encoded
+	return nil
+}
+
+// Attributes returns the GPT attribute bits of the partition.
+func Attributes(p *gpt.Partition) uint64 {
+	return binary.LittleEndian.Uint64(p.Flags[:])
+}
+
+// SetAttributes sets the GPT attribute bits of the partition.
+func SetAttributes(p *gpt.Partition, attributes uint64) {
+	binary.LittleEndian.PutUint64(p.Flags[:], attributes)
+}
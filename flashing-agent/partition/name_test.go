@@ -0,0 +1,57 @@
+package partition
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rekby/gpt"
+)
+
+func TestName(t *testing.T) {
+	var cases = []struct {
+		name          string
+		shouldContain string
+	}{
+		{"", ""},
+		{"root-x86-64", ""},
+		{"données 🐋", ""},
+		{strings.Repeat("a", 36), ""},
+		{strings.Repeat("a", 37), "longer than 36"},
+		{strings.Repeat("🐋", 19), "longer than 36"},
+	}
+	for _, c := range cases {
+		p := gpt.Partition{}
+		SetName(&p, "previous name")
+		e := SetName(&p, c.name)
+		if c.shouldContain != "" {
+			if e == nil || !strings.Contains(e.Error(), c.shouldContain) {
+				t.Errorf("%q: got error %v, want error containing %q", c.name, e, c.shouldContain)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%q: unexpected error: %v", c.name, e)
+		}
+		if act := Name(&p); act != c.name {
+			t.Errorf("got name %q, want %q", act, c.name)
+		}
+	}
+
+	// Encoded as little endian UTF-16.
+	p := gpt.Partition{}
+	SetName(&p, "ESP")
+	if exp := []byte{'E', 0, 'S', 0, 'P', 0, 0, 0}; string(p.PartNameUTF16[:8]) != string(exp) {
+		t.Errorf("got encoded name %v, want %v", p.PartNameUTF16[:8], exp)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	p := gpt.Partition{}
+	SetAttributes(&p, 1<<63|1<<60|1<<2)
+	if exp := (gpt.Flags{0x04, 0, 0, 0, 0, 0, 0, 0x90}); p.Flags != exp {
+		t.Errorf("got flags %v, want %v", p.Flags, exp)
+	}
+	if act := Attributes(&p); act != 1<<63|1<<60|1<<2 {
+		t.Errorf("got attributes %#x", act)
+	}
+}
@@ -19,8 +19,8 @@ func PrintTable(table *gpt.Table, logger *superlog.Logger, title string) {
 			logger.Logf("    (%v empty)\n", consecutiveEmpty)
 			consecutiveEmpty = 0
 		}
-		logger.Logf("    %03d: %12d - %-12d %v (type %v)\n",
-			i, p.FirstLBA, p.LastLBA, p.Id.String(), p.Type.String())
+		logger.Logf("    %03d: %12d - %-12d %v (type %v, name %q, attributes %#x)\n",
+			i, p.FirstLBA, p.LastLBA, p.Id.String(), p.Type.String(), Name(&p), Attributes(&p))
 	}
 	if consecutiveEmpty > 0 {
 		logger.Logf("    (%v empty)\n", consecutiveEmpty)
@@ -0,0 +1,30 @@
+package partition
+
+import (
+	"fmt"
+
+	"github.com/rekby/gpt"
+)
+
+// Translate returns p with its LBAs converted from blocks of fromSize bytes
+// to blocks of toSize bytes. It fails if the partition does not start and
+// end at a multiple of toSize bytes.
+func Translate(p gpt.Partition, fromSize, toSize uint64) (gpt.Partition, error) {
+	if fromSize == 0 || toSize == 0 {
+		return p, fmt.Errorf("Invalid sector size %v or %v.", fromSize, toSize)
+	}
+	if fromSize == toSize {
+		return p, nil
+	}
+	start := p.FirstLBA * fromSize
+	end := (p.LastLBA + 1) * fromSize
+	if start%toSize != 0 || end%toSize != 0 {
+		return p, fmt.Errorf(
+			"Partition %v is not aligned to the disk sector size %v (starts at byte %v, ends before byte %v).",
+			p.Id.String(), toSize, start, end,
+		)
+	}
+	p.FirstLBA = start / toSize
+	p.LastLBA = end/toSize - 1
+	return p, nil
+}
@@ -0,0 +1,43 @@
+package partition
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rekby/gpt"
+)
+
+func TestTranslate(t *testing.T) {
+	var cases = []struct {
+		first, last       uint64
+		fromSize, toSize  uint64
+		expFirst, expLast uint64
+		shouldContain     string
+	}{
+		{40, 79, 512, 512, 40, 79, ""},
+		{40, 79, 512, 4096, 5, 9, ""},
+		{5, 9, 4096, 512, 40, 79, ""},
+		{41, 80, 512, 4096, 0, 0, "starts at byte 20992"},
+		{40, 80, 512, 4096, 0, 0, "ends before byte 41472"},
+		{40, 79, 0, 4096, 0, 0, "Invalid sector size"},
+	}
+	for i, c := range cases {
+		p := gpt.Partition{FirstLBA: c.first, LastLBA: c.last, Id: testUuids[1], Type: gpt.PartType(testUuids[2])}
+		act, e := Translate(p, c.fromSize, c.toSize)
+		if c.shouldContain != "" {
+			if e == nil || !strings.Contains(e.Error(), c.shouldContain) {
+				t.Errorf("Test case %v: got error %v, want error containing %q", i, e, c.shouldContain)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("Test case %v: unexpected error: %v", i, e)
+			continue
+		}
+		exp := p
+		exp.FirstLBA, exp.LastLBA = c.expFirst, c.expLast
+		if !matchesEnough(&exp, &act) {
+			t.Errorf("Test case %v: got %+v, want %+v", i, act, exp)
+		}
+	}
+}
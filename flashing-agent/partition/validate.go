@@ -15,9 +15,18 @@ var zeroUuid = gpt.Guid{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x
 var zeroUuidString = "00000000-0000-0000-0000-000000000000"
 var zeroPartType = gpt.PartType(zeroUuid)
 
+// AssertGptCompatible checks that all partitions of img can be placed on disk.
+// If the sector sizes differ, partitions in img have to start and end
+// at multiples of the disk sector size.
 func AssertGptCompatible(disk, img *gpt.Table) error {
-	if disk.SectorSize != img.SectorSize {
-		return errors.New("Mismated sector sizes")
+	for i := range img.Partitions {
+		p := &img.Partitions[i]
+		if p.IsEmpty() {
+			continue
+		}
+		if _, e := Translate(*p, img.SectorSize, disk.SectorSize); e != nil {
+			return e
+		}
 	}
 	return nil
 }
@@ -80,7 +89,7 @@ func AssertExactMatchIfExists(table *gpt.Table, target *pb.FlashingConfig_Partit
 			MatchesId(p, &target.PartUuid) &&
 			!Matches(p, target, table.SectorSize) {
 			return fmt.Errorf(
-				"Partition %v found, but it's type and/or size are not as expected.",
+				"Partition %v found, but it's type, size, name and/or attributes are not as expected.",
 				target.PartUuid,
 			)
 		}
@@ -108,6 +117,9 @@ func AssertPersistentValid(persistent []pb.FlashingConfig_Partition) error {
 		if _, e := StringToGuid(p.GptType); e != nil {
 			return e
 		}
+		if e := SetName(&gpt.Partition{}, p.Name); e != nil {
+			return e
+		}
 		if strings.ToLower(p.GptType) == zeroUuidString {
 			return fmt.Errorf(
 				"Persistent partition %v has invalid type %v (reserved for blank partitions).",
@@ -117,3 +129,24 @@ func AssertPersistentValid(persistent []pb.FlashingConfig_Partition) error {
 	}
 	return nil
 }
+
+// AssertAligned checks that all partitions start at a multiple of align blocks.
+func AssertAligned(table *gpt.Table, align uint64) error {
+	if align <= 1 {
+		return nil
+	}
+	var misaligned []string
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		if !p.IsEmpty() && p.FirstLBA%align != 0 {
+			misaligned = append(misaligned, p.Id.String())
+		}
+	}
+	if len(misaligned) != 0 {
+		return fmt.Errorf(
+			"Partitions %v do not start at a multiple of %v bytes.",
+			strings.Join(misaligned, ", "), align*table.SectorSize,
+		)
+	}
+	return nil
+}
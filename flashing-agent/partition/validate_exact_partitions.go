@@ -17,7 +17,7 @@ func AssertExistingPartitionsMatchExact(
 			if MatchesId(a, &e.PartUuid) {
 				if !a.IsEmpty() && !Matches(a, e, table.SectorSize) {
 					return fmt.Errorf(
-						"Partition %v exists, but does not have expected type or size.",
+						"Partition %v exists, but does not have expected type, size, name or attributes.",
 						e.PartUuid,
 					)
 				}
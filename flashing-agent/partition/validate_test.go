@@ -17,14 +17,50 @@ func TestAssertGptCompatible(t *testing.T) {
 		shouldContain string
 	}{
 		{gpt.Table{
-			SectorSize: 512,
+			SectorSize: 4096,
 			Header:     gpt.Header{},
 			Partitions: []gpt.Partition{},
 		}, gpt.Table{
-			SectorSize: 1024,
+			SectorSize: 512,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{
+				{FirstLBA: 9, LastLBA: 16, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+			},
+		}, true, "sector"},
+		{gpt.Table{
+			SectorSize: 4096,
 			Header:     gpt.Header{},
 			Partitions: []gpt.Partition{},
+		}, gpt.Table{
+			SectorSize: 512,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{
+				{FirstLBA: 8, LastLBA: 12, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+			},
 		}, true, "sector"},
+		{gpt.Table{
+			SectorSize: 4096,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{},
+		}, gpt.Table{
+			SectorSize: 512,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{
+				{FirstLBA: 8, LastLBA: 15, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+				{FirstLBA: 3, LastLBA: 3, Id: testUuids[2], Type: gpt.PartType(testUuids[0])},
+			},
+		}, false, ""},
+		{gpt.Table{
+			SectorSize: 512,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{},
+		}, gpt.Table{
+			SectorSize: 4096,
+			Header:     gpt.Header{},
+			Partitions: []gpt.Partition{
+				{FirstLBA: 3, LastLBA: 3, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+			},
+		}, false, ""},
 		{gpt.Table{
 			SectorSize: 1024,
 			Header:     gpt.Header{},
@@ -467,3 +503,22 @@ func TestAssertPersistentValid(t *testing.T) {
 		}
 	}
 }
+
+func TestAssertAligned(t *testing.T) {
+	table := gpt.Table{
+		SectorSize: 512,
+		Partitions: []gpt.Partition{
+			{FirstLBA: 2048, LastLBA: 4000, Id: testUuids[1], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 4001, LastLBA: 5000, Id: testUuids[2], Type: gpt.PartType(testUuids[1])},
+			{FirstLBA: 1, LastLBA: 1, Id: testUuids[3], Type: gpt.PartType(testUuids[0])},
+		},
+	}
+	if e := AssertAligned(&table, 1); e != nil {
+		t.Errorf("unexpected error without alignment: %v", e)
+	}
+	e := AssertAligned(&table, 2048)
+	if e == nil || !strings.Contains(e.Error(), testUuids[2].String()) ||
+		strings.Contains(e.Error(), testUuids[1].String()) || !strings.Contains(e.Error(), "1048576 bytes") {
+		t.Errorf("got error %v, want error for partition %v only", e, testUuids[2].String())
+	}
+}
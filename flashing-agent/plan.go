@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rekby/gpt"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/efivars"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// planBootUpdate reads the EFI boot variables and plans the changes
+// which make the machine boot from the new disk layouts, with one entry
+// per target in their order. It does not write anything.
+func planBootUpdate(logger *superlog.Logger, bootEnt *pb.FlashingConfig_BootEntry, targets []*target) (*efivars.Update, error) {
+	oldOrd, e := efivars.ReadBootOrder()
+	if e != nil {
+		return nil, fmt.Errorf("while reading boot order: %v", e)
+	}
+	oldEnts, e := efivars.ReadBootEntries()
+	if e != nil {
+		return nil, fmt.Errorf("while reading boot entries: %v", e)
+	}
+	logger.Logf("old boot order: %04X", oldOrd)
+	logger.Logf("old boot entries:")
+	for k, v := range oldEnts {
+		logger.Logf(" %04X %v", k, v.Description)
+	}
+
+	var newEnts []efivars.BootEntry
+	for _, t := range targets {
+		// The merged table uses the sector size of the disk, like the firmware.
+		newEnt, e := efivars.NewBootEntry(bootEnt.Path, t.table.Partitions)
+		if e != nil {
+			return nil, fmt.Errorf("while creating boot entry in-memory for disk %v: %v", t.serial, e)
+		}
+		newEnts = append(newEnts, *newEnt)
+	}
+
+	up, e := efivars.PlanUpdates(*oldOrd, oldEnts, newEnts)
+	logger.Logf("boot config changes: %+v", up)
+	if e != nil {
+		return nil, fmt.Errorf("while planning update: %v", e)
+	}
+	return up, nil
+}
+
+func tableToPb(table *gpt.Table) *pb.GptTable {
+	out := &pb.GptTable{
+		SectorSize:     table.SectorSize,
+		FirstUsableLba: table.Header.FirstUsableLBA,
+		LastUsableLba:  table.Header.LastUsableLBA,
+	}
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		if p.IsEmpty() {
+			continue
+		}
+		out.Partitions = append(out.Partitions, &pb.GptPartition{
+			Index:      uint32(i),
+			PartUuid:   p.Id.String(),
+			GptType:    p.Type.String(),
+			FirstLba:   p.FirstLBA,
+			LastLba:    p.LastLBA,
+			Name:       partition.Name(p),
+			Attributes: partition.Attributes(p),
+		})
+	}
+	return out
+}
+
+// planToPb describes the changes which flashing would make. up may be nil.
+func planToPb(
+	oldTable *gpt.Table, newTable *gpt.Table, tasks []copyimg.Task,
+	discards []partition.LBARange, up *efivars.Update,
+) *pb.RecordPlanRequest {
+	out := &pb.RecordPlanRequest{
+		OldTable: tableToPb(oldTable),
+		NewTable: tableToPb(newTable),
+	}
+	for _, t := range tasks {
+		out.CopyTasks = append(out.CopyTasks, &pb.CopyTask{Src: t.Src, Dst: t.Dst, Size: t.Size})
+		out.CopyBytes += t.Size
+	}
+	for _, r := range discards {
+		out.DiscardRanges = append(out.DiscardRanges, &pb.ByteRange{
+			Offset: r.FirstLBA * newTable.SectorSize,
+			Length: (r.LastLBA - r.FirstLBA + 1) * newTable.SectorSize,
+		})
+	}
+	if up == nil {
+		return out
+	}
+	for n, ent := range up.Write {
+		out.BootEntries = append(out.BootEntries, &pb.BootEntry{
+			Number:            uint32(n),
+			Description:       ent.Description,
+			Path:              ent.Path,
+			PartitionUuid:     ent.PartitionGUID.String(),
+			PartitionNumber:   ent.PartitionNumber,
+			PartitionStartLba: ent.PartitionStart,
+			PartitionSizeLba:  ent.PartitionSize,
+		})
+	}
+	sort.Slice(out.BootEntries, func(i, j int) bool {
+		return out.BootEntries[i].Number < out.BootEntries[j].Number
+	})
+	for _, n := range up.Order {
+		out.BootOrder = append(out.BootOrder, uint32(n))
+	}
+	return out
+}
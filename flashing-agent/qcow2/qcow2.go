@@ -0,0 +1,340 @@
+// Package qcow2 reads the virtual disk stored in a qcow2 image.
+// Only standalone images are supported (no backing files, encryption or external data files).
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	magic = 0x514649fb // "QFI\xfb"
+
+	// Incompatible feature bits.
+	featDirty         = 1 << 0
+	featCorrupt       = 1 << 1
+	featExternalData  = 1 << 2
+	featCompression   = 1 << 3
+	featExtendedL2    = 1 << 4
+	supportedFeatures = featDirty | featCompression
+
+	offsetMask     = 0x00fffffffffffe00 // host offset in L1 and standard L2 entries
+	l2Compressed   = 1 << 62
+	l2ZeroFlag     = 1 << 0
+	compressedUnit = 512
+
+	compressionDeflate = 0
+	compressionZstd    = 1
+)
+
+type header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// Only in version 3.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// Image is the virtual disk of a qcow2 image. It implements io.ReaderAt.
+// Clusters which are not allocated in the image read as zeros.
+type Image struct {
+	r           io.ReaderAt
+	size        uint64
+	clusterBits uint32
+	compression byte
+	l1          []uint64
+	zstd        *zstd.Decoder // shared by all clusters, DecodeAll is safe for concurrent use
+
+	mu      sync.Mutex
+	l2      map[uint64][]uint64 // by L1 index
+	lastRaw uint64              // L2 entry of the cached compressed cluster
+	last    []byte              // cached decompressed cluster
+}
+
+// Open reads the header and L1 table of the qcow2 image in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	var h header
+	hBuf := make([]byte, binary.Size(h)+1)
+	if n, e := r.ReadAt(hBuf, 0); n < 72 {
+		return nil, fmt.Errorf("while reading qcow2 header: %v", e)
+	}
+	binary.Read(bytes.NewReader(hBuf), binary.BigEndian, &h)
+	if h.Magic != magic {
+		return nil, fmt.Errorf("not a qcow2 image")
+	}
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures = 0
+	case 3:
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %v", h.Version)
+	}
+	if h.BackingFileOffset != 0 {
+		return nil, fmt.Errorf("qcow2 images with backing files are not supported")
+	}
+	if h.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %v", h.ClusterBits)
+	}
+	if f := h.IncompatibleFeatures &^ supportedFeatures; f != 0 {
+		return nil, fmt.Errorf("unsupported qcow2 incompatible features %#x", f)
+	}
+
+	img := &Image{
+		r:           r,
+		size:        h.Size,
+		clusterBits: h.ClusterBits,
+		l2:          make(map[uint64][]uint64),
+	}
+	if h.IncompatibleFeatures&featCompression != 0 {
+		if h.HeaderLength <= 104 {
+			return nil, fmt.Errorf("qcow2 header too short for compression type")
+		}
+		img.compression = hBuf[104]
+		if img.compression != compressionDeflate && img.compression != compressionZstd {
+			return nil, fmt.Errorf("unsupported qcow2 compression type %v", img.compression)
+		}
+	}
+	if img.compression == compressionZstd {
+		var e error
+		if img.zstd, e = zstd.NewReader(nil); e != nil {
+			return nil, e
+		}
+	}
+
+	if need := (h.Size + img.l2Coverage() - 1) / img.l2Coverage(); uint64(h.L1Size) < need {
+		return nil, fmt.Errorf("qcow2 L1 table has %v entries, want at least %v", h.L1Size, need)
+	}
+	l1, e := img.readTable(h.L1TableOffset, int(h.L1Size))
+	if e != nil {
+		img.Close()
+		return nil, fmt.Errorf("while reading qcow2 L1 table: %v", e)
+	}
+	img.l1 = l1
+	return img, nil
+}
+
+// Close releases the decompressor of the image. It does not close the reader passed to Open.
+func (img *Image) Close() error {
+	if img.zstd != nil {
+		img.zstd.Close()
+	}
+	return nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() uint64 {
+	return img.size
+}
+
+func (img *Image) clusterSize() uint64 {
+	return 1 << img.clusterBits
+}
+
+// l2Coverage is the number of virtual bytes mapped by one L2 table.
+func (img *Image) l2Coverage() uint64 {
+	return img.clusterSize() * (img.clusterSize() / 8)
+}
+
+func (img *Image) readTable(offset uint64, n int) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, e := img.r.ReadAt(buf, int64(offset)); e != nil {
+		return nil, e
+	}
+	out := make([]uint64, n)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return out, nil
+}
+
+// l2Entry returns the L2 entry for the cluster containing the virtual offset.
+// It returns 0 if no L2 table is allocated for that cluster.
+func (img *Image) l2Entry(offset uint64) (uint64, error) {
+	l1Idx := offset / img.l2Coverage()
+	img.mu.Lock()
+	table, ok := img.l2[l1Idx]
+	img.mu.Unlock()
+	if !ok {
+		tableOffset := img.l1[l1Idx] & offsetMask
+		if tableOffset == 0 {
+			return 0, nil
+		}
+		var e error
+		table, e = img.readTable(tableOffset, int(img.clusterSize()/8))
+		if e != nil {
+			return 0, fmt.Errorf("while reading qcow2 L2 table: %v", e)
+		}
+		img.mu.Lock()
+		img.l2[l1Idx] = table
+		img.mu.Unlock()
+	}
+	return table[(offset/img.clusterSize())%uint64(len(table))], nil
+}
+
+// ReadAt reads from the virtual disk. Physically contiguous clusters are read
+// with a single call to the underlying reader, so callers should read
+// in large blocks when the image is accessed over the network.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
+	}
+	if uint64(off) >= img.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := img.size - uint64(off); uint64(len(p)) > rest {
+		p = p[:rest]
+		eof = io.EOF
+	}
+
+	cs := img.clusterSize()
+	n := 0
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		entry, e := img.l2Entry(pos)
+		if e != nil {
+			return n, e
+		}
+		l := int(cs - pos%cs)
+		if l > len(p)-n {
+			l = len(p) - n
+		}
+
+		switch {
+		case entry&l2Compressed != 0:
+			data, e := img.readCompressed(entry)
+			if e != nil {
+				return n, e
+			}
+			copy(p[n:n+l], data[pos%cs:])
+		case entry&offsetMask == 0 || entry&l2ZeroFlag != 0:
+			for i := n; i < n+l; i++ {
+				p[i] = 0
+			}
+		default:
+			// Extend the read over following clusters which are stored right after this one.
+			host := entry & offsetMask
+			for n+l < len(p) {
+				next, e := img.l2Entry(pos + uint64(l))
+				if e != nil {
+					return n, e
+				}
+				if next&(l2Compressed|l2ZeroFlag) != 0 || next&offsetMask != host+pos%cs+uint64(l) {
+					break
+				}
+				l += int(cs)
+				if l > len(p)-n {
+					l = len(p) - n
+				}
+			}
+			if _, e := img.r.ReadAt(p[n:n+l], int64(host+pos%cs)); e != nil {
+				return n, fmt.Errorf("while reading qcow2 data at offset %v: %v", pos, e)
+			}
+		}
+		n += l
+	}
+	return n, eof
+}
+
+// readCompressed returns the decompressed data of a compressed cluster.
+func (img *Image) readCompressed(entry uint64) ([]byte, error) {
+	img.mu.Lock()
+	if img.last != nil && img.lastRaw == entry {
+		data := img.last
+		img.mu.Unlock()
+		return data, nil
+	}
+	img.mu.Unlock()
+
+	x := 62 - (img.clusterBits - 8)
+	host := entry & (1<<x - 1)
+	sectors := (entry>>x)&(1<<(62-x)-1) + 1
+	buf := make([]byte, sectors*compressedUnit-host%compressedUnit)
+	n, e := img.r.ReadAt(buf, int64(host))
+	// The last sector may be cut off at the end of the file.
+	if e != nil && !(e == io.EOF && n > 0) {
+		return nil, fmt.Errorf("while reading compressed qcow2 cluster: %v", e)
+	}
+	buf = buf[:n]
+
+	data := make([]byte, img.clusterSize())
+	switch img.compression {
+	case compressionDeflate:
+		_, e = io.ReadFull(flate.NewReader(bytes.NewReader(buf)), data)
+	case compressionZstd:
+		var l int
+		if l, e = zstdFrameLen(buf); e == nil {
+			data, e = img.zstd.DecodeAll(buf[:l], data[:0])
+		}
+		if e == nil && uint64(len(data)) != img.clusterSize() {
+			e = fmt.Errorf("got %v bytes, want %v", len(data), img.clusterSize())
+		}
+	}
+	if e != nil {
+		return nil, fmt.Errorf("while decompressing qcow2 cluster: %v", e)
+	}
+
+	img.mu.Lock()
+	img.lastRaw, img.last = entry, data
+	img.mu.Unlock()
+	return data, nil
+}
+
+// zstdFrameLen returns the length of the zstd frame at the start of buf.
+// Compressed clusters are followed by padding up to the end of their last sector,
+// which DecodeAll would reject as an invalid frame.
+func zstdFrameLen(buf []byte) (int, error) {
+	var h zstd.Header
+	rest, e := h.DecodeAndStrip(buf)
+	if e != nil {
+		return 0, e
+	}
+	if h.Skippable {
+		return 0, fmt.Errorf("unexpected skippable zstd frame")
+	}
+	n := len(buf) - len(rest)
+	for last := false; !last; {
+		if n+3 > len(buf) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		bh := uint32(buf[n]) | uint32(buf[n+1])<<8 | uint32(buf[n+2])<<16
+		last = bh&1 != 0
+		n += 3
+		if (bh>>1)&3 == 1 { // RLE blocks store a single byte
+			n++
+		} else {
+			n += int(bh >> 3)
+		}
+	}
+	if h.HasCheckSum {
+		n += 4
+	}
+	if n > len(buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
@@ -0,0 +1,200 @@
+package qcow2_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/qcow2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	clusterBits  = 9
+	clusterSize  = 1 << clusterBits
+	virtClusters = 70 // needs two L2 tables
+)
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	calls int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.calls++
+	return c.r.ReadAt(p, off)
+}
+
+func fill(seed byte) []byte {
+	d := make([]byte, clusterSize)
+	for i := range d {
+		d[i] = seed + byte(i*7/5)
+	}
+	return d
+}
+
+// buildImage returns a qcow2 image and the contents of its virtual disk.
+// Virtual clusters 0 and 1 are stored contiguously, 2 has the zero flag,
+// 3 is unallocated, 4 is compressed, 5 and 6 are stored in reverse order
+// and the second L2 table (clusters 64 and later) is unallocated.
+func buildImage(t *testing.T, zstdCompression bool) ([]byte, []byte) {
+	virt := make([]byte, virtClusters*clusterSize)
+	for _, c := range []int{0, 1, 4, 5, 6} {
+		copy(virt[c*clusterSize:], fill(byte(c*31)))
+	}
+	// Highly compressible, so that it fits in a single sector.
+	copy(virt[4*clusterSize:], bytes.Repeat([]byte{0x42}, clusterSize))
+
+	var compressed []byte
+	if zstdCompression {
+		enc, _ := zstd.NewWriter(nil)
+		compressed = enc.EncodeAll(virt[4*clusterSize:5*clusterSize], nil)
+	} else {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(virt[4*clusterSize : 5*clusterSize])
+		w.Close()
+		compressed = buf.Bytes()
+	}
+
+	// Host clusters: 0 header, 1 L1 table, 2 L2 table, 3-4 data, 5 compressed data, 6-7 data.
+	img := make([]byte, 8*clusterSize)
+	h := struct {
+		Magic, Version                      uint32
+		BackingFileOffset                   uint64
+		BackingFileSize, ClusterBits        uint32
+		Size                                uint64
+		CryptMethod, L1Size                 uint32
+		L1TableOffset, RefcountOffset       uint64
+		RefcountClusters, NbSnapshots       uint32
+		SnapshotsOffset                     uint64
+		Incompatible, Compatible, Autoclear uint64
+		RefcountOrder, HeaderLength         uint32
+		CompressionType                     uint8
+	}{
+		Magic: 0x514649fb, Version: 3, ClusterBits: clusterBits,
+		Size: virtClusters * clusterSize, L1Size: 2, L1TableOffset: 1 * clusterSize,
+		RefcountOrder: 4, HeaderLength: 112,
+	}
+	if zstdCompression {
+		h.Incompatible = 1 << 3
+		h.CompressionType = 1
+	}
+	var hBuf bytes.Buffer
+	binary.Write(&hBuf, binary.BigEndian, h)
+	copy(img, hBuf.Bytes())
+
+	put := func(off int, v uint64) { binary.BigEndian.PutUint64(img[off:], v) }
+	put(1*clusterSize, 1<<63|2*clusterSize)
+	l2 := 2 * clusterSize
+	put(l2+0*8, 1<<63|3*clusterSize)
+	put(l2+1*8, 1<<63|4*clusterSize)
+	put(l2+2*8, 1)
+	compOff := uint64(5*clusterSize + 7)
+	x := uint(62 - (clusterBits - 8))
+	extraSectors := (compOff%512 + uint64(len(compressed)) - 1) / 512
+	put(l2+4*8, 1<<62|extraSectors<<x|compOff)
+	put(l2+5*8, 1<<63|7*clusterSize)
+	put(l2+6*8, 1<<63|6*clusterSize)
+
+	copy(img[3*clusterSize:], virt[0:2*clusterSize])
+	copy(img[compOff:], compressed)
+	// Compressed clusters are packed at byte granularity, so another one may follow in the same sector.
+	copy(img[compOff+uint64(len(compressed)):], compressed)
+	copy(img[7*clusterSize:], virt[5*clusterSize:6*clusterSize])
+	copy(img[6*clusterSize:], virt[6*clusterSize:7*clusterSize])
+	return img, virt
+}
+
+func TestImageRead(t *testing.T) {
+	for _, useZstd := range []bool{false, true} {
+		raw, virt := buildImage(t, useZstd)
+		img, e := qcow2.Open(bytes.NewReader(raw))
+		if e != nil {
+			t.Fatalf("unexpected error while opening: %v", e)
+		}
+		if img.Size() != uint64(len(virt)) {
+			t.Errorf("got size %v, want %v", img.Size(), len(virt))
+		}
+
+		for _, chunk := range []int{1, 100, clusterSize, 3000, len(virt) + 10} {
+			act, e := ioutil.ReadAll(io.LimitReader(
+				&chunkReader{io.NewSectionReader(img, 0, int64(len(virt))), chunk}, int64(len(virt))+1))
+			if e != nil {
+				t.Errorf("zstd %v, chunk %v: unexpected error: %v", useZstd, chunk, e)
+			}
+			if !bytes.Equal(act, virt) {
+				t.Errorf("zstd %v, chunk %v: got different data", useZstd, chunk)
+			}
+		}
+
+		p := make([]byte, 20)
+		n, e := img.ReadAt(p, int64(len(virt)-10))
+		if n != 10 || e != io.EOF || !bytes.Equal(p[:n], virt[len(virt)-10:]) {
+			t.Errorf("got (%v, %v) at end of disk, want (10, EOF)", n, e)
+		}
+		img.Close()
+	}
+}
+
+func TestImageReadContiguous(t *testing.T) {
+	raw, virt := buildImage(t, false)
+	cr := &countingReaderAt{r: bytes.NewReader(raw)}
+	img, e := qcow2.Open(cr)
+	if e != nil {
+		t.Fatalf("unexpected error while opening: %v", e)
+	}
+	img.ReadAt(make([]byte, 1), 0) // loads the L2 table
+	cr.calls = 0
+	p := make([]byte, 2*clusterSize-20)
+	if _, e := img.ReadAt(p, 10); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !bytes.Equal(p, virt[10:2*clusterSize-10]) {
+		t.Errorf("got different data")
+	}
+	if cr.calls != 1 {
+		t.Errorf("got %v reads for contiguous clusters, want 1", cr.calls)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	raw, _ := buildImage(t, false)
+	cases := []struct {
+		label  string
+		offset int
+		value  uint32
+	}{
+		{"bad magic", 0, 0x12345678},
+		{"bad version", 4, 4},
+		{"backing file", 8, 1},
+		{"encrypted", 32, 1},
+		{"bad cluster bits", 20, 30},
+		{"unknown feature", 72 + 4, 1 << 5},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			img := append([]byte{}, raw...)
+			binary.BigEndian.PutUint32(img[c.offset:], c.value)
+			if _, e := qcow2.Open(bytes.NewReader(img)); e == nil {
+				t.Errorf("got no error, want some error")
+			}
+		})
+	}
+}
+
+// chunkReader reads at most n bytes at a time.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
@@ -2,6 +2,7 @@ package superlog
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -45,19 +46,89 @@ func (l *Logger) Logf(format string, v ...interface{}) {
 	l.logString(fmt.Sprintf(format, v...))
 }
 
-func (l *Logger) Progress(p float32) {
+// Progress describes how far the current phase of flashing got.
+type Progress struct {
+	Phase      pb.FlashingPhase
+	BytesDone  uint64
+	BytesTotal uint64
+	Partition  string        // unique GUID of the partition being written, empty if none
+	Throughput float64       // smoothed, in bytes per second
+	ETA        time.Duration // estimated time remaining, negative if unknown
+}
+
+// Fraction returns the fraction of the phase which is done.
+func (p Progress) Fraction() float32 {
+	if p.BytesTotal == 0 {
+		return 0
+	}
+	return float32(float64(p.BytesDone) / float64(p.BytesTotal))
+}
+
+func (p Progress) String() string {
+	eta := "unknown"
+	if p.ETA >= 0 {
+		eta = p.ETA.String()
+	}
+	part := p.Partition
+	if part == "" {
+		part = "none"
+	}
+	return fmt.Sprintf("%v: %v of %v bytes (%.1f%%), partition %v, %.0f bytes/s, ETA %v",
+		p.Phase, p.BytesDone, p.BytesTotal, 100*p.Fraction(), part, p.Throughput, eta)
+}
+
+func (l *Logger) Progress(p Progress) {
 	l.baseLogger.Printf("Progress: %v", p)
 	c := l.superviseClient
 	if c != nil {
+		eta := int64(-1)
+		if p.ETA >= 0 {
+			eta = int64(p.ETA / time.Second)
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		c.RecordProgress(ctx, &pb.RecordProgressRequest{
-			SessionId: l.sessID,
-			Progress:  p,
+			SessionId:      l.sessID,
+			Progress:       p.Fraction(),
+			Phase:          p.Phase,
+			BytesDone:      p.BytesDone,
+			BytesTotal:     p.BytesTotal,
+			Partition:      p.Partition,
+			BytesPerSecond: p.Throughput,
+			EtaSeconds:     eta,
 		})
 	}
 }
 
+// Plan logs a summary of planned changes and sends them to the supervisor.
+// Like for backups, failing to send them is an error.
+func (l *Logger) Plan(r *pb.RecordPlanRequest) error {
+	l.baseLogger.Printf("Plan: %v copy tasks (%v bytes), %v partitions, %v discard ranges, %v boot entries to write",
+		len(r.CopyTasks), r.CopyBytes, len(r.NewTable.GetPartitions()), len(r.DiscardRanges), len(r.BootEntries))
+	c := l.superviseClient
+	if c == nil {
+		return errors.New("no supervisor to send plan to")
+	}
+	r.SessionId = l.sessID
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, e := c.RecordPlan(ctx, r)
+	return e
+}
+
+// Backup sends a backup to the supervisor. Unlike logs, failing to send it
+// is an error, including when no supervisor is attached.
+func (l *Logger) Backup(b *pb.Backup) error {
+	c := l.superviseClient
+	if c == nil {
+		return errors.New("no supervisor to send backup to")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, e := c.RecordBackup(ctx, &pb.RecordBackupRequest{SessionId: l.sessID, Backup: b})
+	return e
+}
+
 func (l *Logger) AttachSupervisor(client pb.FlashingSupervisorClient, sessID uint64) {
 	l.superviseClient = client
 	l.sessID = sessID
@@ -0,0 +1,78 @@
+package superlog
+
+import (
+	"time"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// sampleInterval is the minimum time between throughput samples,
+// which is also the minimum time between progress reports.
+var sampleInterval = time.Second
+
+// smoothing is the weight of the newest sample in the throughput average.
+const smoothing = 0.3
+
+// Tracker reports the progress of one phase, including throughput and ETA.
+// It is not safe for concurrent use.
+type Tracker struct {
+	logger    *Logger
+	p         Progress
+	now       func() time.Time
+	last      time.Time // time of the last sample
+	lastBytes uint64    // BytesDone at the last sample
+}
+
+// Track starts a phase with the given number of bytes to process and reports it.
+func (l *Logger) Track(phase pb.FlashingPhase, total uint64) *Tracker {
+	return l.track(phase, total, time.Now)
+}
+
+func (l *Logger) track(phase pb.FlashingPhase, total uint64, now func() time.Time) *Tracker {
+	t := &Tracker{
+		logger: l,
+		p:      Progress{Phase: phase, BytesTotal: total, ETA: -1},
+		now:    now,
+		last:   now(),
+	}
+	l.Progress(t.p)
+	return t
+}
+
+// Add records that n more bytes were processed, while writing the given partition.
+// Progress is reported at most every sampleInterval, and when the phase is done.
+func (t *Tracker) Add(n uint64, partition string) {
+	t.p.BytesDone += n
+	t.p.Partition = partition
+	now := t.now()
+	dt := now.Sub(t.last)
+	done := t.p.BytesDone >= t.p.BytesTotal
+	if dt < sampleInterval && !done {
+		return
+	}
+	if dt > 0 {
+		rate := float64(t.p.BytesDone-t.lastBytes) / dt.Seconds()
+		if t.p.Throughput == 0 {
+			t.p.Throughput = rate
+		} else {
+			t.p.Throughput = smoothing*rate + (1-smoothing)*t.p.Throughput
+		}
+	}
+	t.last = now
+	t.lastBytes = t.p.BytesDone
+	switch {
+	case done:
+		t.p.ETA = 0
+	case t.p.Throughput > 0:
+		rest := float64(t.p.BytesTotal - t.p.BytesDone)
+		t.p.ETA = time.Duration(rest / t.p.Throughput * float64(time.Second))
+	default:
+		t.p.ETA = -1
+	}
+	t.logger.Progress(t.p)
+}
+
+// Progress returns the current progress.
+func (t *Tracker) Progress() Progress {
+	return t.p
+}
@@ -0,0 +1,45 @@
+package superlog
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+func TestTracker(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(log.New(&buf, "", 0))
+	now := time.Unix(1000, 0)
+	tr := l.track(pb.FlashingPhase_COPYING, 1000, func() time.Time { return now })
+
+	steps := []struct {
+		after      time.Duration
+		n          uint64
+		expReports int
+		expRate    float64
+		expETA     time.Duration
+	}{
+		{0, 100, 1, 0, -1},                          // too early for a sample
+		{time.Second, 100, 2, 200, 4 * time.Second}, // 200 bytes in 1s, 800 left
+		{time.Second, 100, 3, 170, 4117647058},      // 0.3*100 + 0.7*200, 700 left
+		{time.Second, 700, 4, 329, 0},               // 0.3*700 + 0.7*170, done
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		tr.Add(s.n, "part")
+		p := tr.Progress()
+		if act := bytes.Count(buf.Bytes(), []byte("\n")); act != s.expReports {
+			t.Errorf("step %v: got %v reports, want %v", i, act, s.expReports)
+		}
+		if p.Throughput != s.expRate || p.ETA != s.expETA {
+			t.Errorf("step %v: got %v bytes/s, ETA %v, want %v bytes/s, ETA %v",
+				i, p.Throughput, p.ETA, s.expRate, s.expETA)
+		}
+	}
+	if p := tr.Progress(); p.BytesDone != 1000 || p.Fraction() != 1 || p.Partition != "part" {
+		t.Errorf("unexpected final progress %+v", p)
+	}
+}
@@ -0,0 +1,147 @@
+// Package sysinfo reads hardware properties which ghw does not provide
+// from sysfs and procfs.
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+var dmiPath = "/sys/class/dmi/id"
+var netPath = "/sys/class/net"
+var procPath = "/proc"
+
+// ReadSystemIdentity reads the DMI/SMBIOS identity of the machine.
+// Fields which are missing or can't be read (some need root) are empty.
+func ReadSystemIdentity() *pb.Inventory_SystemIdentity {
+	r := func(name string) string {
+		d, e := ioutil.ReadFile(path.Join(dmiPath, name))
+		if e != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(d))
+	}
+	return &pb.Inventory_SystemIdentity{
+		SysVendor:      r("sys_vendor"),
+		ProductName:    r("product_name"),
+		ProductVersion: r("product_version"),
+		ProductSerial:  r("product_serial"),
+		ProductUuid:    r("product_uuid"),
+		BoardVendor:    r("board_vendor"),
+		BoardName:      r("board_name"),
+		BoardSerial:    r("board_serial"),
+		BiosVendor:     r("bios_vendor"),
+		BiosVersion:    r("bios_version"),
+		BiosDate:       r("bios_date"),
+		ChassisSerial:  r("chassis_serial"),
+	}
+}
+
+// LinkSpeed returns the speed of a network interface in Mbit/s,
+// or 0 if it is unknown or the link is down.
+func LinkSpeed(nic string) uint64 {
+	d, e := ioutil.ReadFile(path.Join(netPath, nic, "speed"))
+	if e != nil {
+		return 0
+	}
+	// Drivers report -1 if the speed is unknown.
+	s, e := strconv.ParseUint(strings.TrimSpace(string(d)), 10, 64)
+	if e != nil {
+		return 0
+	}
+	return s
+}
+
+// ReadCPU summarizes /proc/cpuinfo.
+func ReadCPU() (*pb.Inventory_Cpu, error) {
+	f, e := os.Open(path.Join(procPath, "cpuinfo"))
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return parseCPUInfo(f)
+}
+
+func parseCPUInfo(r io.Reader) (*pb.Inventory_Cpu, error) {
+	out := &pb.Inventory_Cpu{}
+	sockets := make(map[string]bool)
+	cores := make(map[string]bool)
+	var physID string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		i := strings.IndexByte(s.Text(), ':')
+		if i < 0 {
+			continue
+		}
+		k := strings.TrimSpace(s.Text()[:i])
+		v := strings.TrimSpace(s.Text()[i+1:])
+		switch k {
+		case "processor":
+			out.Threads++
+			physID = ""
+		case "vendor_id":
+			out.Vendor = v
+		case "model name":
+			out.Model = v
+		case "physical id":
+			physID = v
+			sockets[v] = true
+		case "core id":
+			cores[physID+"/"+v] = true
+		}
+	}
+	if e := s.Err(); e != nil {
+		return nil, e
+	}
+	if out.Threads == 0 {
+		return nil, fmt.Errorf("no processors found")
+	}
+	// Some architectures (eg. ARM) don't report sockets and cores.
+	out.Sockets = uint32(len(sockets))
+	if out.Sockets == 0 {
+		out.Sockets = 1
+	}
+	out.Cores = uint32(len(cores))
+	if out.Cores == 0 {
+		out.Cores = out.Threads
+	}
+	return out, nil
+}
+
+// ReadMemoryBytes returns the memory usable by the kernel.
+func ReadMemoryBytes() (uint64, error) {
+	f, e := os.Open(path.Join(procPath, "meminfo"))
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	return parseMemInfo(f)
+}
+
+func parseMemInfo(r io.Reader) (uint64, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// eg. "MemTotal:       16305260 kB"
+		f := strings.Fields(s.Text())
+		if len(f) != 3 || f[0] != "MemTotal:" || f[2] != "kB" {
+			continue
+		}
+		kb, e := strconv.ParseUint(f[1], 10, 64)
+		if e != nil {
+			return 0, fmt.Errorf("bad MemTotal %q: %v", f[1], e)
+		}
+		return kb * 1024, nil
+	}
+	if e := s.Err(); e != nil {
+		return 0, e
+	}
+	return 0, fmt.Errorf("no MemTotal found")
+}
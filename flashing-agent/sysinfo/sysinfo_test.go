@@ -0,0 +1,122 @@
+package sysinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+var cpuinfoTwoSockets = `processor	: 0
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU E5-2620 v3 @ 2.40GHz
+physical id	: 0
+core id		: 0
+
+processor	: 1
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU E5-2620 v3 @ 2.40GHz
+physical id	: 0
+core id		: 0
+
+processor	: 2
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU E5-2620 v3 @ 2.40GHz
+physical id	: 1
+core id		: 0
+
+processor	: 3
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU E5-2620 v3 @ 2.40GHz
+physical id	: 1
+core id		: 1
+`
+
+var cpuinfoARM = `processor	: 0
+BogoMIPS	: 108.00
+Features	: fp asimd evtstrm crc32 cpuid
+
+processor	: 1
+BogoMIPS	: 108.00
+Features	: fp asimd evtstrm crc32 cpuid
+`
+
+func TestParseCPUInfo(t *testing.T) {
+	c, e := parseCPUInfo(strings.NewReader(cpuinfoTwoSockets))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if c.Vendor != "GenuineIntel" || c.Model != "Intel(R) Xeon(R) CPU E5-2620 v3 @ 2.40GHz" {
+		t.Errorf("got vendor %q and model %q", c.Vendor, c.Model)
+	}
+	if c.Sockets != 2 || c.Cores != 3 || c.Threads != 4 {
+		t.Errorf("got %v sockets, %v cores, %v threads, want 2, 3, 4", c.Sockets, c.Cores, c.Threads)
+	}
+
+	c, e = parseCPUInfo(strings.NewReader(cpuinfoARM))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if c.Sockets != 1 || c.Cores != 2 || c.Threads != 2 {
+		t.Errorf("got %v sockets, %v cores, %v threads, want 1, 2, 2", c.Sockets, c.Cores, c.Threads)
+	}
+
+	if _, e := parseCPUInfo(strings.NewReader("")); e == nil {
+		t.Errorf("got no error for empty cpuinfo, want some error")
+	}
+}
+
+func TestParseMemInfo(t *testing.T) {
+	m, e := parseMemInfo(strings.NewReader("MemTotal:       16305260 kB\nMemFree:         1234 kB\n"))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if m != 16305260*1024 {
+		t.Errorf("got %v bytes, want %v", m, 16305260*1024)
+	}
+	if _, e := parseMemInfo(strings.NewReader("MemFree: 1234 kB\n")); e == nil {
+		t.Errorf("got no error without MemTotal, want some error")
+	}
+}
+
+func TestReadSysfs(t *testing.T) {
+	dir, e := ioutil.TempDir("", "sysinfo")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, n string) { dmiPath, netPath = d, n }(dmiPath, netPath)
+	dmiPath = path.Join(dir, "dmi")
+	netPath = path.Join(dir, "net")
+
+	files := map[string]string{
+		"dmi/sys_vendor":    "Supermicro\n",
+		"dmi/product_uuid":  "00000000-0000-0000-0000-0cc47a000000\n",
+		"net/eth0/speed":    "10000\n",
+		"net/eth1/speed":    "-1\n",
+		"dmi/board_name":    "X10SRi-F\n",
+		"dmi/chassis_class": "ignored\n",
+	}
+	for k, d := range files {
+		p := path.Join(dir, k)
+		if e := os.MkdirAll(path.Dir(p), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := ioutil.WriteFile(p, []byte(d), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	id := ReadSystemIdentity()
+	if id.SysVendor != "Supermicro" || id.BoardName != "X10SRi-F" ||
+		id.ProductUuid != "00000000-0000-0000-0000-0cc47a000000" || id.ProductSerial != "" {
+		t.Errorf("got unexpected system identity %+v", id)
+	}
+
+	for nic, exp := range map[string]uint64{"eth0": 10000, "eth1": 0, "eth2": 0} {
+		if s := LinkSpeed(nic); s != exp {
+			t.Errorf("%v: got speed %v, want %v", nic, s, exp)
+		}
+	}
+}
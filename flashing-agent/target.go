@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/rekby/gpt"
+	"github.com/tehwalris/ghw"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/copyimg"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/disk"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/efivars"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/partition"
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/superlog"
+	pb "git.dolansoft.org/philippe/softmetal/pb"
+)
+
+// target is a disk which gets the image, with its own layout and copy tasks.
+type target struct {
+	serial   string
+	pers     []pb.FlashingConfig_Partition
+	f        *os.File
+	info     *ghw.Disk
+	oldTable gpt.Table  // as read from the disk
+	table    *gpt.Table // merged with the image
+	tasks    []copyimg.Task
+	unmapped []copyimg.Task // parts of tasks which the block map does not cover
+	discards []partition.LBARange
+}
+
+// targetDisks returns the disks to flash. Configs with a single disk
+// may use target_disk_combined_serial or target_disk instead of target_disks.
+func targetDisks(config *pb.FlashingConfig) ([]*pb.FlashingConfig_TargetDisk, error) {
+	if config.TargetDisk != nil && config.TargetDiskCombinedSerial != "" {
+		return nil, fmt.Errorf("target_disk can't be combined with target_disk_combined_serial")
+	}
+	if len(config.TargetDisks) == 0 {
+		return []*pb.FlashingConfig_TargetDisk{{
+			CombinedSerial:       config.TargetDiskCombinedSerial,
+			PersistentPartitions: config.PersistentPartitions,
+			Selector:             config.TargetDisk,
+		}}, nil
+	}
+	if config.TargetDiskCombinedSerial != "" || config.TargetDisk != nil || len(config.PersistentPartitions) != 0 {
+		return nil, fmt.Errorf("target_disks can't be combined with " +
+			"target_disk_combined_serial, target_disk or persistent_partitions")
+	}
+	return config.TargetDisks, nil
+}
+
+// openTarget opens a disk and reads its GPT. Unless dryRun is set,
+// a backup is sent to the supervisor before anything is written.
+func openTarget(
+	logger *superlog.Logger, td *pb.FlashingConfig_TargetDisk, dryRun bool, isEFI bool,
+) (*target, error) {
+	t := &target{}
+	for _, p := range td.PersistentPartitions {
+		t.pers = append(t.pers, *p)
+	}
+	var e error
+	if td.Selector != nil {
+		logger.Logf("selecting disk (%v)", disk.SelectorString(td.Selector))
+		t.f, t.info, e = disk.Open(td.Selector, dryRun)
+	} else {
+		t.f, t.info, e = disk.OpenBySerial(td.CombinedSerial, dryRun)
+	}
+	if e != nil {
+		return nil, e
+	}
+	t.serial = t.info.SerialNumber
+	logger.Logf("using disk %v with serial %v", t.info.Name, t.serial)
+
+	table, didCreateGpt, e := disk.GetOrCreateGpt(t.f, t.info)
+	if e != nil {
+		t.close(logger)
+		return nil, e
+	}
+	if didCreateGpt {
+		logger.Logf("using new blank GPT table (no table found on disk)")
+	} else {
+		logger.Logf("using existing GPT table from disk")
+	}
+	partition.PrintTable(table, logger, "Old GPT table from disk")
+	t.table = table
+	t.oldTable = *table
+	t.oldTable.Partitions = append([]gpt.Partition(nil), table.Partitions...)
+
+	if !dryRun {
+		b, e := readBackup(t.f, t.info, t.serial, table, isEFI)
+		if e != nil {
+			t.close(logger)
+			return nil, fmt.Errorf("while reading backup: %v", e)
+		}
+		if e := logger.Backup(b); e != nil {
+			t.close(logger)
+			return nil, fmt.Errorf("while sending backup to supervisor: %v", e)
+		}
+		logger.Logf("sent backup of %v disk regions and %v boot variables", len(b.DiskRegions), len(b.EfiVariables))
+	}
+	return t, nil
+}
+
+func (t *target) close(logger *superlog.Logger) {
+	if e := t.f.Close(); e != nil {
+		logger.Logf("while closing disk %v: %v", t.serial, e)
+	}
+}
+
+// merge merges the image GPT into t.table. Nothing is written to the disk.
+func (t *target) merge(logger *superlog.Logger, config *pb.FlashingConfig, imgTable *gpt.Table) error {
+	table := t.table
+	alignment := config.PartitionAlignment
+	if alignment == 0 {
+		alignment = defaultAlignment
+	}
+	if alignment%table.SectorSize != 0 {
+		return fmt.Errorf("partition alignment %v is not a multiple of the sector size %v",
+			alignment, table.SectorSize)
+	}
+	align := alignment / table.SectorSize
+	if imgTable.SectorSize != table.SectorSize {
+		logger.Logf("translating image partitions from %v to %v byte sectors", imgTable.SectorSize, table.SectorSize)
+	}
+	if e := copyimg.MergeGpt(table, imgTable, t.pers, align); e != nil {
+		return fmt.Errorf("while merging GPT: %v", e)
+	}
+	grown, blocks, e := copyimg.GrowPartitions(table, imgTable, config.GrowPartitions, align)
+	if e != nil {
+		return fmt.Errorf("while growing partitions: %v", e)
+	}
+	if grown != nil {
+		logger.Logf("grew partition %v by %v bytes", grown.Id.String(), blocks*table.SectorSize)
+	}
+	partition.PrintTable(table, logger, "Merged GPT")
+	if e := partition.AssertAligned(table, align); e != nil {
+		// Only existing persistent partitions can be misaligned.
+		logger.Logf("WARNING: %v", e)
+	}
+	return nil
+}
+
+// writeTable writes the merged GPT and a protective MBR to the disk.
+func (t *target) writeTable() error {
+	table := t.table
+	if e := table.Write(t.f); e != nil {
+		return fmt.Errorf("while writing disk-start GPT: %v", e)
+	}
+	if e := table.CreateOtherSideTable().Write(t.f); e != nil {
+		return fmt.Errorf("while writing disk-end GPT: %v", e)
+	}
+	if e := disk.WritePMBR(t.f, t.info.SectorSizeBytes, t.info.SizeBytes); e != nil {
+		return fmt.Errorf("while writing protective MBR: %v", e)
+	}
+	return nil
+}
+
+// renewESPGuid gives the EFI System partition from the image a new random
+// GUID. Mirror disks use it, so that the boot entry of each disk points at
+// its own ESP. It has to be called after planning the copy tasks, since
+// they match partitions by GUID.
+func (t *target) renewESPGuid(logger *superlog.Logger, imgTable *gpt.Table) error {
+	for i := range t.table.Partitions {
+		p := &t.table.Partitions[i]
+		old := p.Id.String()
+		if p.IsEmpty() || !efivars.IsESP(p) || !partition.ContainsId(imgTable.Partitions, &old) {
+			continue
+		}
+		id, e := uuid.NewRandom()
+		if e != nil {
+			return e
+		}
+		p.Id = gpt.Guid(id)
+		logger.Logf("using GUID %v instead of %v for ESP on disk %v", p.Id.String(), old, t.serial)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package throttle limits the rate at which data is read.
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxWait is roughly the longest a single read waits, so that
+// rate changes take effect soon even at very low rates.
+const maxWait = 100 * time.Millisecond
+
+// minPiece is the smallest number of bytes read at once.
+const minPiece = 512
+
+// Limiter limits the combined rate of all readers created from it.
+// The rate may be changed at any time.
+type Limiter struct {
+	mu   sync.Mutex
+	rate uint64    // bytes per second, unlimited if 0
+	debt float64   // bytes which were read ahead of the rate
+	last time.Time // time at which debt was last updated
+}
+
+// New returns a Limiter for the given rate in bytes per second (unlimited if 0).
+func New(rate uint64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// SetRate changes the rate in bytes per second (unlimited if 0).
+func (l *Limiter) SetRate(rate uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.debt = 0
+}
+
+// Rate returns the current rate in bytes per second.
+func (l *Limiter) Rate() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// piece returns how many of n bytes should be read at once.
+func (l *Limiter) piece(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return n
+	}
+	max := int(l.rate * uint64(maxWait) / uint64(time.Second))
+	if max < minPiece {
+		max = minPiece
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// wait accounts for n bytes which were read and sleeps
+// until they are within the rate.
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.debt -= now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	if l.debt < 0 {
+		l.debt = 0
+	}
+	l.debt += float64(n)
+	l.last = now
+	d := time.Duration(l.debt / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// Reader returns a reader which reads from r at most at the rate of l.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &reader{r, l}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, e := r.r.Read(p[:r.l.piece(len(p))])
+	r.l.wait(n)
+	return n, e
+}
+
+// ReaderAt returns a ReaderAt which reads from r at most at the rate of l.
+func (l *Limiter) ReaderAt(r io.ReaderAt) io.ReaderAt {
+	return &readerAt{r, l}
+}
+
+type readerAt struct {
+	r io.ReaderAt
+	l *Limiter
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	var done int
+	for done < len(p) {
+		n, e := r.r.ReadAt(p[done:done+r.l.piece(len(p)-done)], off+int64(done))
+		r.l.wait(n)
+		done += n
+		if e != nil {
+			return done, e
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,70 @@
+package throttle_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/throttle"
+)
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 100*1000)
+	l := throttle.New(400 * 1000)
+	start := time.Now()
+	act, e := ioutil.ReadAll(l.Reader(bytes.NewReader(data)))
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if !bytes.Equal(act, data) {
+		t.Errorf("read data differs")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Errorf("reading took %v, want about 250ms", d)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	data := make([]byte, 100*1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	l := throttle.New(400 * 1000)
+	r := l.ReaderAt(bytes.NewReader(data))
+	start := time.Now()
+	act := make([]byte, len(data)-10)
+	if n, e := r.ReadAt(act, 10); n != len(act) || e != nil {
+		t.Fatalf("got %v, %v, want %v, nil", n, e, len(act))
+	}
+	if !bytes.Equal(act, data[10:]) {
+		t.Errorf("read data differs")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Errorf("reading took %v, want about 250ms", d)
+	}
+	if n, e := r.ReadAt(make([]byte, 20), int64(len(data)-10)); n != 10 || e != io.EOF {
+		t.Errorf("got %v, %v at the end, want 10, EOF", n, e)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	data := make([]byte, 10*1000*1000)
+	l := throttle.New(1000)
+	r := l.Reader(bytes.NewReader(data))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l.SetRate(0)
+	}()
+	start := time.Now()
+	if _, e := io.Copy(ioutil.Discard, r); e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("reading took %v after removing the limit", d)
+	}
+	if l.Rate() != 0 {
+		t.Errorf("got rate %v, want 0", l.Rate())
+	}
+}
@@ -15,5 +15,8 @@ var machines = map[string]pb.FlashingConfig{
 	},
 	"zaba": {
 		TargetDiskCombinedSerial: "Samsung_SSD_840_EVO_500GB_S1DHNSAF443735Z",
+		// Instead of the serial, a selector can match a replacement disk, eg.
+		// TargetDisk: &pb.DiskSelector{Model: "Samsung_SSD_840_EVO_500GB", NonRemovable: true},
+		// but it fails as ambiguous if more than one disk matches.
 	},
 }
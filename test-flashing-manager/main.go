@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync/atomic"
+	"time"
 
+	"git.dolansoft.org/philippe/softmetal/flashing-agent/mcast"
 	pb "git.dolansoft.org/philippe/softmetal/pb"
 	"google.golang.org/grpc"
 )
@@ -17,34 +26,290 @@ var grpcListen = flag.String("grpc-listen", ":6781", "address and port to listen
 var machineName = flag.String("machine", "", "name of machine to flash (see machines.go, required)")
 var imageURL = flag.String("image", "", "URL of the disk image to flash (required)")
 var bootPath = flag.String("boot-path", "", "path to EFI bootloader on ESP in image (required)")
+var imageSHA256 = flag.String("image-sha256", "", "hex encoded SHA-256 of the uncompressed image")
+var maxRetries = flag.Uint("max-retries", 10, "number of times agents may resume the image download")
+var verifyWritten = flag.Bool("verify-written", false, "read back and check all data written to disk")
+var zeroBlocks = flag.String("zero-blocks", "WRITE_ZEROS", "how agents handle zero blocks (WRITE_ZEROS, ZERO_OUT or SKIP_ZEROS)")
+var bmapURL = flag.String("bmap-url", "", "URL of a block map for the image (optional)")
+var discardUnmapped = flag.Bool("discard-unmapped", false, "discard ranges not covered by the block map")
+var imageFormat = flag.String("image-format", "RAW", "format of the image (RAW or QCOW2)")
+var parallelDownloads = flag.Uint("parallel-downloads", 1, "number of concurrent range requests for the image")
+var deltaManifestURL = flag.String("delta-manifest-url", "", "URL of a block checksum manifest for delta flashing (optional)")
+var caCertsFile = flag.String("ca-certs", "", "PEM file with CA certificates agents trust for HTTPS (optional)")
+var s3Endpoint = flag.String("s3-endpoint", "", "object store for s3:// URLs (AWS if empty, keys are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+var s3Region = flag.String("s3-region", "", "region of the object store for s3:// URLs")
+var directIO = flag.Bool("direct-io", false, "write image data to disk with O_DIRECT")
+var multicastGroup = flag.String("multicast-group", "", "multicast group (address:port) to send the image to (optional)")
+var multicastImage = flag.String("multicast-image", "", "local copy of the image file to send to the multicast group")
+var multicastAgents = flag.Uint64("multicast-agents", 1, "number of agents to wait for before sending the image")
+var multicastDelay = flag.Duration("multicast-delay", 10*time.Second, "time to wait after the last agent connected before sending the image")
+var multicastRate = flag.Int64("multicast-rate", 50*1000*1000, "bytes per second to send to the multicast group")
+var growPartition = flag.String("grow-partition", "", "unique GUID of an image partition to grow into free disk space (optional)")
+var growPartitionType = flag.String("grow-partition-type", "", "type GUID of an image partition to grow into free disk space (optional)")
+var partitionAlignment = flag.Uint64("partition-alignment", 0, "alignment of new partitions in bytes (1 MiB if 0)")
+var bandwidthLimit = flag.Uint64("bandwidth-limit", 0, "bytes per second agents may read the image at (0 for unlimited, change with /bandwidth-limit?bytes-per-second=N)")
+var multicastFEC = flag.Int("multicast-fec", 16, "data packets per parity packet (0 to disable)")
+var discard = flag.String("discard", "NO_DISCARD", "discard free and new partition space (NO_DISCARD, DISCARD or SECURE_DISCARD)")
+var discardAfterCopy = flag.Bool("discard-after-copy", false, "discard after copying the image instead of before")
+var backupDir = flag.String("backup-dir", "backups", "directory to store backups of the GPT and boot variables which agents send")
+var inventoryDir = flag.String("inventory-dir", "inventory", "directory to store the hardware inventory which agents send, one file per machine")
+var restoreBackup = flag.String("restore-backup", "", "backup file from -backup-dir to restore instead of flashing (optional)")
+var mirrorDisk = flag.String("mirror-disk", "", "serial of a second disk which gets the same image (optional)")
+var dryRun = flag.Bool("dry-run", false, "ask agents to only report the planned changes")
 
 type supervisorServer struct {
 	agentIDCounter uint64
+	bandwidthLimit uint64 // accessed atomically
+	caCertsPEM     string
+	streamID       uint64
+	restoreBackup  *pb.Backup
 }
 
 func (s *supervisorServer) GetCommand(ctx context.Context, r *pb.Empty) (*pb.FlashingCommand, error) {
 	sid := atomic.AddUint64(&s.agentIDCounter, 1)
 	log.Printf("SUPER %v: agent connected", sid)
+	if s.restoreBackup != nil {
+		log.Printf("SUPER %v: restoring backup of disk %v", sid, s.restoreBackup.DiskCombinedSerial)
+		return &pb.FlashingCommand{
+			SessionId:         sid,
+			PowerOnCompletion: pb.PowerControlType_REBOOT,
+			RestoreBackup:     s.restoreBackup,
+		}, nil
+	}
+	if *multicastGroup != "" && sid == *multicastAgents {
+		go s.sendMulticast()
+	}
 	c, _ := machines[*machineName]
+	c.VerifyWritten = *verifyWritten
+	c.ZeroBlocks = pb.ZeroBlockMode(pb.ZeroBlockMode_value[*zeroBlocks])
+	c.DirectIo = *directIO
+	c.PartitionAlignment = *partitionAlignment
+	c.Discard = pb.DiscardMode(pb.DiscardMode_value[*discard])
+	c.DiscardAfterCopy = *discardAfterCopy
+	if *mirrorDisk != "" {
+		c.TargetDisks = []*pb.FlashingConfig_TargetDisk{
+			{CombinedSerial: c.TargetDiskCombinedSerial, PersistentPartitions: c.PersistentPartitions},
+			{CombinedSerial: *mirrorDisk},
+		}
+		c.TargetDiskCombinedSerial = ""
+		c.PersistentPartitions = nil
+	}
+	if *growPartition != "" || *growPartitionType != "" {
+		c.GrowPartitions = []*pb.FlashingConfig_GrowPartition{
+			{PartUuid: *growPartition, GptType: *growPartitionType},
+		}
+	}
 	c.ImageConfig = &pb.FlashingConfig_ImageConfig{
-		Url:        *imageURL,
-		SectorSize: 512,
-		BootEntry:  &pb.FlashingConfig_BootEntry{Path: *bootPath},
+		Url:               *imageURL,
+		SectorSize:        512,
+		BootEntry:         &pb.FlashingConfig_BootEntry{Path: *bootPath},
+		Sha256:            *imageSHA256,
+		MaxRetries:        uint32(*maxRetries),
+		Format:            pb.ImageFormat(pb.ImageFormat_value[*imageFormat]),
+		BmapUrl:           *bmapURL,
+		DiscardUnmapped:   *discardUnmapped,
+		ParallelDownloads: uint32(*parallelDownloads),
+		DeltaManifestUrl:  *deltaManifestURL,
+		CaCertsPem:        s.caCertsPEM,
+		MulticastGroup:    *multicastGroup,
+		MulticastStreamId: s.streamID,
+	}
+	// Keys are only sent to agents which need them.
+	if usesS3(*imageURL, *bmapURL, *deltaManifestURL) {
+		c.ImageConfig.S3 = &pb.FlashingConfig_S3Config{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
 	}
 	return &pb.FlashingCommand{
 		SessionId:         sid,
 		Config:            &c,
 		PowerOnCompletion: pb.PowerControlType_REBOOT,
+		BandwidthLimit:    &pb.BandwidthLimit{BytesPerSecond: atomic.LoadUint64(&s.bandwidthLimit)},
+		DryRun:            *dryRun,
 	}, nil
 }
 
+// usesS3 returns whether any of the URLs is an s3:// URL.
+func usesS3(urls ...string) bool {
+	for _, u := range urls {
+		if p, e := url.Parse(u); e == nil && p.Scheme == "s3" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *supervisorServer) GetBandwidthLimit(ctx context.Context, r *pb.GetBandwidthLimitRequest) (*pb.BandwidthLimit, error) {
+	return &pb.BandwidthLimit{BytesPerSecond: atomic.LoadUint64(&s.bandwidthLimit)}, nil
+}
+
+func (s *supervisorServer) handleBandwidthLimit(w http.ResponseWriter, r *http.Request) {
+	if v := r.FormValue("bytes-per-second"); v != "" {
+		limit, e := strconv.ParseUint(v, 10, 64)
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		atomic.StoreUint64(&s.bandwidthLimit, limit)
+		log.Printf("SUPER: bandwidth limit changed to %v bytes/s", limit)
+	}
+	fmt.Fprintf(w, "%v\n", atomic.LoadUint64(&s.bandwidthLimit))
+}
+
+func (s *supervisorServer) sendMulticast() {
+	log.Printf("SUPER: sending image to %v in %v", *multicastGroup, *multicastDelay)
+	time.Sleep(*multicastDelay)
+	f, e := os.Open(*multicastImage)
+	check(e)
+	defer f.Close()
+	info, e := f.Stat()
+	check(e)
+	dst, e := net.ResolveUDPAddr("udp", *multicastGroup)
+	check(e)
+	conn, e := net.ListenPacket("udp", ":0")
+	check(e)
+	defer conn.Close()
+	e = mcast.Send(conn, dst, f, uint64(info.Size()), mcast.SendOptions{
+		StreamID:  s.streamID,
+		GroupSize: *multicastFEC,
+		Rate:      *multicastRate,
+	})
+	if e != nil {
+		log.Printf("SUPER: multicast failed: %v", e)
+		return
+	}
+	log.Printf("SUPER: sent image to %v", *multicastGroup)
+}
+
 func (s *supervisorServer) RecordLog(ctx context.Context, r *pb.RecordLogRequest) (*pb.Empty, error) {
 	log.Printf("AGENT %v LOG: %v", r.SessionId, r.Log)
 	return &pb.Empty{}, nil
 }
 
 func (s *supervisorServer) RecordProgress(ctx context.Context, r *pb.RecordProgressRequest) (*pb.Empty, error) {
-	log.Printf("AGENT %v PROGRESS: %v", r.SessionId, r.Progress)
+	eta := "unknown"
+	if r.EtaSeconds >= 0 {
+		eta = (time.Duration(r.EtaSeconds) * time.Second).String()
+	}
+	log.Printf("AGENT %v PROGRESS: %v %.1f%% (%v of %v bytes), partition %q, %.0f bytes/s, ETA %v",
+		r.SessionId, r.Phase, 100*r.Progress, r.BytesDone, r.BytesTotal, r.Partition, r.BytesPerSecond, eta)
+	return &pb.Empty{}, nil
+}
+
+// logTable logs a GPT, with each line starting with prefix (eg. "AGENT 1 PLAN").
+func logTable(prefix string, name string, t *pb.GptTable) {
+	if t == nil {
+		return
+	}
+	log.Printf("%v: %v table, sector size %v, usable LBA %v-%v:",
+		prefix, name, t.SectorSize, t.FirstUsableLba, t.LastUsableLba)
+	for _, p := range t.Partitions {
+		log.Printf("%v:  #%v %v type %v LBA %v-%v name %q attributes %#x",
+			prefix, p.Index, p.PartUuid, p.GptType, p.FirstLba, p.LastLba, p.Name, p.Attributes)
+	}
+}
+
+func (s *supervisorServer) RecordPlan(ctx context.Context, r *pb.RecordPlanRequest) (*pb.Empty, error) {
+	log.Printf("AGENT %v PLAN: disk %v", r.SessionId, r.DiskCombinedSerial)
+	prefix := fmt.Sprintf("AGENT %v PLAN", r.SessionId)
+	logTable(prefix, "old", r.OldTable)
+	logTable(prefix, "new", r.NewTable)
+	log.Printf("AGENT %v PLAN: %v copy tasks, %v bytes", r.SessionId, len(r.CopyTasks), r.CopyBytes)
+	for _, t := range r.CopyTasks {
+		log.Printf("AGENT %v PLAN:  copy %v bytes from %v to %v", r.SessionId, t.Size, t.Src, t.Dst)
+	}
+	for _, d := range r.DiscardRanges {
+		log.Printf("AGENT %v PLAN:  discard %v bytes at %v", r.SessionId, d.Length, d.Offset)
+	}
+	for _, b := range r.BootEntries {
+		log.Printf("AGENT %v PLAN: write boot entry %04X %q (%v on partition %v)",
+			r.SessionId, b.Number, b.Description, b.Path, b.PartitionUuid)
+	}
+	if len(r.BootOrder) > 0 {
+		log.Printf("AGENT %v PLAN: boot order %04X", r.SessionId, r.BootOrder)
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *supervisorServer) RecordBackup(ctx context.Context, r *pb.RecordBackupRequest) (*pb.Empty, error) {
+	if r.Backup == nil {
+		return nil, fmt.Errorf("missing backup")
+	}
+	d, e := json.Marshal(r.Backup)
+	if e != nil {
+		return nil, e
+	}
+	// Mirrored disks are backed up in the same session and second.
+	// Existing backups are never overwritten.
+	name := filepath.Join(*backupDir, fmt.Sprintf("%v-session-%v-%v.json",
+		time.Now().Format("20060102-150405"), r.SessionId, filepath.Base(r.Backup.DiskCombinedSerial)))
+	if e := writeNewFile(name, d); e != nil {
+		log.Printf("AGENT %v BACKUP: failed to store: %v", r.SessionId, e)
+		return nil, e
+	}
+	log.Printf("AGENT %v BACKUP: stored backup of disk %v (%v regions, %v boot variables) in %v",
+		r.SessionId, r.Backup.DiskCombinedSerial, len(r.Backup.DiskRegions), len(r.Backup.EfiVariables), name)
+	return &pb.Empty{}, nil
+}
+
+// writeNewFile writes d to a file which must not exist yet.
+func writeNewFile(name string, d []byte) error {
+	f, e := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write(d); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// machineID identifies the machine of an inventory across reboots, by its
+// DMI UUID or serial, or the MAC address of its first physical NIC.
+func machineID(inv *pb.Inventory) string {
+	if id := inv.System.GetProductUuid(); id != "" {
+		return id
+	}
+	if id := inv.System.GetProductSerial(); id != "" {
+		return id
+	}
+	for _, n := range inv.Nics {
+		if !n.Virtual && n.MacAddress != "" {
+			return n.MacAddress
+		}
+	}
+	return fmt.Sprintf("unknown-%v", time.Now().Format("20060102-150405"))
+}
+
+func (s *supervisorServer) ReportInventory(ctx context.Context, r *pb.ReportInventoryRequest) (*pb.Empty, error) {
+	inv := r.Inventory
+	if inv == nil {
+		return nil, fmt.Errorf("missing inventory")
+	}
+	d, e := json.MarshalIndent(inv, "", "  ")
+	if e != nil {
+		return nil, e
+	}
+	// Agents send the inventory before they have a session.
+	id := machineID(inv)
+	prefix := fmt.Sprintf("MACHINE %v INVENTORY", id)
+	name := filepath.Join(*inventoryDir, filepath.Base(id)+".json")
+	if e := ioutil.WriteFile(name, d, 0600); e != nil {
+		log.Printf("%v: failed to store: %v", prefix, e)
+		return nil, e
+	}
+	log.Printf("%v: %v %v, %v disks, %v NICs, stored in %v",
+		prefix, inv.System.GetSysVendor(), inv.System.GetProductName(), len(inv.Disks), len(inv.Nics), name)
+	for _, d := range inv.Disks {
+		// Printed so that it can be copied into machines.go.
+		log.Printf("%v:  disk %v (%v, %v bytes): TargetDiskCombinedSerial: %q",
+			prefix, d.Name, d.Model, d.Size, d.CombinedSerial)
+		logTable(prefix, "existing", d.Gpt)
+	}
 	return &pb.Empty{}, nil
 }
 
@@ -65,19 +330,51 @@ func check(e error) {
 
 func main() {
 	flag.Parse()
-	if *imageURL == "" || *machineName == "" || *bootPath == "" {
+	if *restoreBackup == "" && (*imageURL == "" || *machineName == "" || *bootPath == "") {
 		log.Fatalf("missing required arguments, see -help")
 	}
-	if _, prs := machines[*machineName]; !prs {
+	if _, prs := machines[*machineName]; !prs && *restoreBackup == "" {
 		log.Fatalf("no machine profile named %v", *machineName)
 	}
+	if _, prs := pb.ZeroBlockMode_value[*zeroBlocks]; !prs {
+		log.Fatalf("invalid zero block mode %v", *zeroBlocks)
+	}
+	if _, prs := pb.ImageFormat_value[*imageFormat]; !prs {
+		log.Fatalf("invalid image format %v", *imageFormat)
+	}
+	if _, prs := pb.DiscardMode_value[*discard]; !prs {
+		log.Fatalf("invalid discard mode %v", *discard)
+	}
+
+	if *multicastGroup != "" && *multicastImage == "" {
+		log.Fatalf("-multicast-group requires -multicast-image")
+	}
+
+	srv := &supervisorServer{
+		streamID:       uint64(time.Now().UnixNano()),
+		bandwidthLimit: *bandwidthLimit,
+	}
+	check(os.MkdirAll(*backupDir, 0700))
+	check(os.MkdirAll(*inventoryDir, 0700))
+	if *restoreBackup != "" {
+		d, e := ioutil.ReadFile(*restoreBackup)
+		check(e)
+		srv.restoreBackup = &pb.Backup{}
+		check(json.Unmarshal(d, srv.restoreBackup))
+	}
+	if *caCertsFile != "" {
+		caCerts, e := ioutil.ReadFile(*caCertsFile)
+		check(e)
+		srv.caCertsPEM = string(caCerts)
+	}
 
 	lis, e := net.Listen("tcp", *grpcListen)
 	check(e)
 	s := grpc.NewServer()
-	pb.RegisterFlashingSupervisorServer(s, &supervisorServer{})
+	pb.RegisterFlashingSupervisorServer(s, srv)
 
 	http.HandleFunc("/", handleHTTP)
+	http.HandleFunc("/bandwidth-limit", srv.handleBandwidthLimit)
 	http.HandleFunc("/agent-linux-amd64", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "../flashing-agent/flashing-agent")
 	})